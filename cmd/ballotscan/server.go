@@ -20,10 +20,16 @@ import (
 
 type ScanServer struct {
 	bubbleCache     map[int64]*scan.BubblesJson
-	pngCache        map[int64][]byte
+	templateCache   map[templateKey]*scan.Template
+	pngCache        map[templateKey][]byte
 	bubbleCacheLock sync.Mutex
 
-	appPrefix    string
+	appPrefix string
+
+	// studioPrefix is the ballotstudio service, which must serve
+	// {studioPrefix}/election/{electionid}_bubbles.json,
+	// {studioPrefix}/election/{electionid}.png for a one page ballot, and
+	// {studioPrefix}/election/{electionid}_p{page}.png for each page (from 0) of a multi-page ballot
 	studioPrefix string
 
 	getter *http.Client
@@ -31,10 +37,17 @@ type ScanServer struct {
 	archiver ImageArchiver
 }
 
+// templateKey is one page of one election
+type templateKey struct {
+	electionid int64
+	page       int
+}
+
 func NewScanServer() *ScanServer {
 	out := new(ScanServer)
 	out.bubbleCache = make(map[int64]*scan.BubblesJson)
-	out.pngCache = make(map[int64][]byte)
+	out.templateCache = make(map[templateKey]*scan.Template)
+	out.pngCache = make(map[templateKey][]byte)
 	out.appPrefix = ""
 	out.studioPrefix = ""
 	out.getter = http.DefaultClient
@@ -58,6 +71,31 @@ func jsonResponse(w http.ResponseWriter, code int, ob interface{}) {
 	w.Write(jb)
 }
 
+// scanErrorStatus picks the HTTP status for an error from the scan package
+func scanErrorStatus(reason scan.Reason) int {
+	switch reason {
+	case scan.ReasonUnsupportedImage:
+		return http.StatusUnsupportedMediaType
+	case scan.ReasonNoTopBorder, scan.ReasonNoFiducials, scan.ReasonAlignmentDiverged, scan.ReasonMisaligned:
+		// a readable image that isn't a ballot we can register
+		return http.StatusUnprocessableEntity
+	case scan.ReasonTemplateLoad, scan.ReasonDebugOutput, scan.ReasonImageRead:
+		// trouble on the server's side, not with the request
+		return http.StatusInternalServerError
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+// scanErrorResponse sends {"reason": machine readable code, "error": human readable message}
+func scanErrorResponse(w http.ResponseWriter, err error) {
+	reason := scan.ErrorReason(err)
+	jsonResponse(w, scanErrorStatus(reason), map[string]string{
+		"reason": string(reason),
+		"error":  err.Error(),
+	})
+}
+
 func (ss *ScanServer) studioUrl(suffix string) string {
 	ub, err := url.Parse(ss.studioPrefix)
 	if err != nil {
@@ -82,6 +120,7 @@ func (ss *ScanServer) getBubbles(electionid int64) (bj *scan.BubblesJson, err er
 	if err != nil {
 		return nil, fmt.Errorf("GET %v, %s", url, err.Error())
 	}
+	defer response.Body.Close()
 	contentType := response.Header.Get("Content-Type")
 	if contentType != "application/json" {
 		return nil, fmt.Errorf("bubbles not json but %#v", contentType)
@@ -98,20 +137,27 @@ func (ss *ScanServer) getBubbles(electionid int64) (bj *scan.BubblesJson, err er
 }
 
 // Looks up pallot png from ballotstudio service {studioPrefix}/election/{electionid}.png
-func (ss *ScanServer) getBallotPNG(electionid int64) (pngbytes []byte, err error) {
+// Pages of a multi-page ballot are {studioPrefix}/election/{electionid}_p{page}.png
+func (ss *ScanServer) getBallotPNG(electionid int64, page int, pageCount int) (pngbytes []byte, err error) {
+	key := templateKey{electionid, page}
 	// two small lock windows. do _not_ hold the lock during potentially slow HTTP GET
 	ss.bubbleCacheLock.Lock()
 	var ok bool
-	pngbytes, ok = ss.pngCache[electionid]
+	pngbytes, ok = ss.pngCache[key]
 	ss.bubbleCacheLock.Unlock()
 	if ok {
 		return pngbytes, nil
 	}
-	url := ss.studioUrl(fmt.Sprintf("/election/%d.png", electionid))
+	suffix := fmt.Sprintf("/election/%d.png", electionid)
+	if pageCount > 1 {
+		suffix = fmt.Sprintf("/election/%d_p%d.png", electionid, page)
+	}
+	url := ss.studioUrl(suffix)
 	response, err := ss.getter.Get(url)
 	if err != nil {
 		return nil, fmt.Errorf("GET %v, %s", url, err.Error())
 	}
+	defer response.Body.Close()
 	contentType := response.Header.Get("Content-Type")
 	if contentType != "image/png" {
 		return nil, fmt.Errorf("not png but %#v", contentType)
@@ -119,13 +165,63 @@ func (ss *ScanServer) getBallotPNG(electionid int64) (pngbytes []byte, err error
 	pngbytes, err = ioutil.ReadAll(response.Body)
 	if err == nil {
 		ss.bubbleCacheLock.Lock()
-		ss.pngCache[electionid] = pngbytes
+		ss.pngCache[key] = pngbytes
 		ss.bubbleCacheLock.Unlock()
 	}
 	return pngbytes, err
 }
 
+// getTemplate returns the prepared scan template for one page of the ballot, building it from the ballot png the first time.
+// On error it has already written the HTTP response.
+func (ss *ScanServer) getTemplate(w http.ResponseWriter, electionid int64, bubbles *scan.BubblesJson, page int) (tmpl *scan.Template, ok bool) {
+	key := templateKey{electionid, page}
+	// two small lock windows. do _not_ hold the lock during potentially slow HTTP GET
+	ss.bubbleCacheLock.Lock()
+	tmpl, ok = ss.templateCache[key]
+	ss.bubbleCacheLock.Unlock()
+	if ok {
+		return tmpl, true
+	}
+	pngbytes, err := ss.getBallotPNG(electionid, page, bubbles.PageCount())
+	if err != nil {
+		log.Printf("failed to get png for election %d page %d: %s", electionid, page, err.Error())
+		textResponse(w, http.StatusInternalServerError, "png lookup")
+		return nil, false
+	}
+	orig, format, err := image.Decode(bytes.NewReader(pngbytes))
+	if err != nil {
+		log.Printf("bad png decode %d page %d: %v %s", electionid, page, format, err.Error())
+		textResponse(w, http.StatusInternalServerError, "png decode")
+		return nil, false
+	}
+	tmpl, err = scan.NewTemplate(bubbles.Page(page), orig)
+	if err != nil {
+		log.Printf("bad template election %d page %d: %s", electionid, page, err.Error())
+		scanErrorResponse(w, err)
+		return nil, false
+	}
+	ss.bubbleCacheLock.Lock()
+	ss.templateCache[key] = tmpl
+	ss.bubbleCacheLock.Unlock()
+	return tmpl, true
+}
+
+// pageScanners sets up a Scanner for each of the first npages pages of the ballot.
+// On error it has already written the HTTP response.
+func (ss *ScanServer) pageScanners(w http.ResponseWriter, electionid int64, bubbles *scan.BubblesJson, npages int) (scanners []*scan.Scanner, ok bool) {
+	scanners = make([]*scan.Scanner, npages)
+	for page := range scanners {
+		tmpl, ok := ss.getTemplate(w, electionid, bubbles, page)
+		if !ok {
+			return nil, false
+		}
+		scanners[page] = scan.NewScanner(tmpl)
+	}
+	return scanners, true
+}
+
 // {appPrefix}/scan/{electionid}
+// POST one image, or a multipart form with one image part per page in page order: front, back, next sheet front, ...
 func (ss *ScanServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	path := r.URL.Path
 	if len(ss.appPrefix) > 0 {
@@ -158,23 +254,16 @@ func (ss *ScanServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		textResponse(w, http.StatusInternalServerError, "bubble lookup")
 		return
 	}
-	pngbytes, err := ss.getBallotPNG(electionid)
+	err = bubbles.CheckPages()
 	if err != nil {
-		log.Printf("failed to get png for election %d: %s", electionid, err.Error())
-		textResponse(w, http.StatusInternalServerError, "png lookup")
+		log.Printf("bad pages for election %d: %s", electionid, err.Error())
+		scanErrorResponse(w, err)
 		return
 	}
-	orig, format, err := image.Decode(bytes.NewReader(pngbytes))
-	if err != nil {
-		log.Printf("bad png decode %d: %v %s", electionid, format, err.Error())
-		textResponse(w, http.StatusInternalServerError, "png decode")
-		return
-	}
-
-	var s scan.Scanner
-	s.Bj = *bubbles
-	s.SetOrigImage(orig)
+	pageCount := bubbles.PageCount()
 
+	images := make([][]byte, 0, pageCount)
+	msgs := make([]string, 0, pageCount)
 	if isImage(r.Header.Get("Content-Type")) {
 		// raw POST body image
 		// TODO: configurable max size, now 10 MB
@@ -184,58 +273,102 @@ func (ss *ScanServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			textResponse(w, http.StatusBadRequest, err.Error())
 			return
 		}
-		ss.doim(w, r, imbytes, &s, "post body")
-		return
-	}
-
-	mpreader, err := r.MultipartReader()
-	if err != nil {
-		textResponse(w, http.StatusBadRequest, err.Error())
-		return
-	}
-	for true {
-		part, err := mpreader.NextPart()
-		if err == io.EOF {
-			break
-		} else if err != nil {
+		images = append(images, imbytes)
+		msgs = append(msgs, "post body")
+	} else {
+		mpreader, err := r.MultipartReader()
+		if err != nil {
 			textResponse(w, http.StatusBadRequest, err.Error())
 			return
 		}
-
-		log.Printf("got part cd=%v fn=%v form=%v", part.Header.Get("Content-Disposition"), part.FileName(), part.FormName())
-		if isImage(part.Header.Get("Content-Type")) {
-			imbytes, err := ioutil.ReadAll(part)
-			if err != nil {
-				log.Printf("bad image part cd=%v fn=%v form=%v format=%v err=%v", part.Header.Get("Content-Disposition"), part.FileName(), part.FormName(), format, err)
-				textResponse(w, http.StatusBadRequest, "bad image part")
+		for true {
+			part, err := mpreader.NextPart()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				textResponse(w, http.StatusBadRequest, err.Error())
 				return
 			}
-			msg := fmt.Sprintf("cd=%v fn=%v form=%v", part.Header.Get("Content-Disposition"), part.FileName(), part.FormName())
-			ss.doim(w, r, imbytes, &s, msg)
-			return
+
+			log.Printf("got part cd=%v fn=%v form=%v", part.Header.Get("Content-Disposition"), part.FileName(), part.FormName())
+			if isImage(part.Header.Get("Content-Type")) {
+				if len(images) >= pageCount {
+					textResponse(w, http.StatusBadRequest, fmt.Sprintf("more images than the %d pages of the ballot", pageCount))
+					return
+				}
+				imbytes, err := ioutil.ReadAll(part)
+				if err != nil {
+					log.Printf("bad image part cd=%v fn=%v form=%v err=%v", part.Header.Get("Content-Disposition"), part.FileName(), part.FormName(), err)
+					textResponse(w, http.StatusBadRequest, "bad image part")
+					return
+				}
+				images = append(images, imbytes)
+				msgs = append(msgs, fmt.Sprintf("cd=%v fn=%v form=%v", part.Header.Get("Content-Disposition"), part.FileName(), part.FormName()))
+			}
 		}
 	}
-	textResponse(w, http.StatusBadRequest, "no image?")
+	if len(images) == 0 {
+		textResponse(w, http.StatusBadRequest, "no image?")
+		return
+	}
+	if len(images) != pageCount {
+		// a lost back side must not look like a ballot with nothing on it
+		textResponse(w, http.StatusBadRequest, fmt.Sprintf("%d images for the %d pages of the ballot", len(images), pageCount))
+		return
+	}
+
+	scanners, ok := ss.pageScanners(w, electionid, bubbles, len(images))
+	if !ok {
+		return
+	}
+	if pageCount == 1 {
+		ss.doim(w, r, images[0], scanners[0], msgs[0])
+		return
+	}
+	ss.doBallot(w, r, images, scanners, msgs, bubbles)
 }
 
 func isImage(contentType string) bool {
 	return strings.HasPrefix(contentType, "image/")
 }
 
-func (ss *ScanServer) doim(w http.ResponseWriter, r *http.Request, imbytes []byte, s *scan.Scanner, msg string) {
+// scanImage decodes and scans one page image. On error it has already written the HTTP response.
+func (ss *ScanServer) scanImage(w http.ResponseWriter, r *http.Request, imbytes []byte, s *scan.Scanner, msg string) (result *scan.ScanResult, ok bool) {
 	im, format, err := image.Decode(bytes.NewReader(imbytes))
 	if err != nil {
 		log.Printf("bad image decode %v format=%v err=%v", msg, format, err)
-		textResponse(w, http.StatusBadRequest, "bad image")
-		return
+		scanErrorResponse(w, &scan.Error{Reason: scan.ReasonUnsupportedImage, Msg: "bad image", Err: err})
+		return nil, false
 	}
 	if ss.archiver != nil {
 		go ss.archiver.ArchiveImage(imbytes, r)
 	}
-	marked, err := s.ProcessScannedImage(im)
+	result, err = s.ProcessScannedImage(im)
 	if err != nil {
-		textResponse(w, http.StatusBadRequest, err.Error())
+		log.Printf("scan failed %v: %s", msg, err.Error())
+		scanErrorResponse(w, err)
+		return nil, false
+	}
+	return result, true
+}
+
+func (ss *ScanServer) doim(w http.ResponseWriter, r *http.Request, imbytes []byte, s *scan.Scanner, msg string) {
+	result, ok := ss.scanImage(w, r, imbytes, s, msg)
+	if !ok {
 		return
 	}
-	jsonResponse(w, http.StatusOK, marked)
+	jsonResponse(w, http.StatusOK, result)
+}
+
+// doBallot scans each page image against its page and returns the merged ballot
+func (ss *ScanServer) doBallot(w http.ResponseWriter, r *http.Request, images [][]byte, scanners []*scan.Scanner, msgs []string, bubbles *scan.BubblesJson) {
+	pages := make([]*scan.ScanResult, len(images))
+	for i, imbytes := range images {
+		result, ok := ss.scanImage(w, r, imbytes, scanners[i], msgs[i])
+		if !ok {
+			return
+		}
+		pages[i] = result
+	}
+	jsonResponse(w, http.StatusOK, scan.MergePages(bubbles, pages))
 }
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"testing"
+
+	"github.com/brianolson/ballotscan/scan"
+)
+
+// fakeStudio serves bubbles json for any election
+func fakeStudio(t *testing.T, bj *scan.BubblesJson) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(bj)
+		if err != nil {
+			t.Error(err)
+		}
+	}))
+}
+
+func TestMissingPageRejected(t *testing.T) {
+	bj := &scan.BubblesJson{
+		DrawSettings: &scan.DrawSettings{PageSize: []float64{612, 792}},
+		Pages:        []scan.Page{{Sheet: 0, Side: scan.SideFront}, {Sheet: 0, Side: scan.SideBack}},
+	}
+	studio := fakeStudio(t, bj)
+	defer studio.Close()
+	ss := NewScanServer()
+	ss.studioPrefix = studio.URL
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, err := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"image/png"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write([]byte("front only"))
+	mw.Close()
+	req := httptest.NewRequest("POST", "/scan/1", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	rec := httptest.NewRecorder()
+	ss.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("one image for two pages got %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestScanErrorStatus(t *testing.T) {
+	cases := []struct {
+		reason scan.Reason
+		status int
+	}{
+		{scan.ReasonUnsupportedImage, http.StatusUnsupportedMediaType},
+		{scan.ReasonNoTopBorder, http.StatusUnprocessableEntity},
+		{scan.ReasonNoFiducials, http.StatusUnprocessableEntity},
+		{scan.ReasonAlignmentDiverged, http.StatusUnprocessableEntity},
+		{scan.ReasonMisaligned, http.StatusUnprocessableEntity},
+		{scan.ReasonTemplateLoad, http.StatusInternalServerError},
+		{scan.ReasonDebugOutput, http.StatusInternalServerError},
+		{scan.ReasonImageRead, http.StatusInternalServerError},
+		{"", http.StatusBadRequest},
+	}
+	for _, tc := range cases {
+		if got := scanErrorStatus(tc.reason); got != tc.status {
+			t.Errorf("%q: got %d, want %d", tc.reason, got, tc.status)
+		}
+	}
+
+}
+
+// The ballot png is fetched once per page, even when it doesn't make a template.
+func TestBallotPNGCached(t *testing.T) {
+	gets := 0
+	studio := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gets++
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("not really a png"))
+	}))
+	defer studio.Close()
+	ss := NewScanServer()
+	ss.studioPrefix = studio.URL
+	for i := 0; i < 2; i++ {
+		for page := 0; page < 2; page++ {
+			pngbytes, err := ss.getBallotPNG(1, page, 2)
+			if err != nil || string(pngbytes) != "not really a png" {
+				t.Fatalf("page %d: %v %q", page, err, pngbytes)
+			}
+		}
+	}
+	if gets != 2 {
+		t.Errorf("%d GETs for 2 pages", gets)
+	}
+}
@@ -0,0 +1,131 @@
+package scan
+
+import (
+	"image"
+	"math"
+)
+
+// ThresholdMethod is how a scan is split into dark and light pixels.
+type ThresholdMethod int
+
+const (
+	// ThresholdOtsu is one threshold for the whole page, from its histogram.
+	ThresholdOtsu ThresholdMethod = iota
+
+	// ThresholdSauvola thresholds each pixel at m * (1 + k*(s/R - 1)) from the mean m and deviation s around it.
+	// It follows shading and gradients across the page and leaves blank paper light.
+	ThresholdSauvola
+
+	// ThresholdNiblack thresholds each pixel at m + k*s around it, s no less than niblackMinDeviation
+	// so the grain of blank paper doesn't come out dark.
+	ThresholdNiblack
+)
+
+const sauvolaK = 0.2
+const sauvolaR = 128.0
+const niblackK = -0.2
+const niblackMinDeviation = 16.0
+
+// The adaptive threshold window is this fraction of the scan's shorter side. It has to be bigger than
+// a filled bubble or fiducial, or the middle of one looks like the background and comes out light.
+const adaptiveWindowFraction = 1.0 / 16
+
+// window sums of squares stay inside 32 bits up to this size
+const maxAdaptiveWindow = 255
+
+// a scan flattened by adaptiveFlatten is split into dark and light at this value
+const flatThreshold = 128
+
+// integralImage is the sum of pixels and of their squares above and left of each point.
+// The sums wrap around 32 bits, but the sum over any window small enough to fit still comes out right.
+type integralImage struct {
+	stride int
+	sum    []uint32
+	sq     []uint32
+}
+
+func newIntegralImage(im *image.Gray) *integralImage {
+	w := im.Rect.Dx()
+	h := im.Rect.Dy()
+	ii := &integralImage{
+		stride: w + 1,
+		sum:    make([]uint32, (w+1)*(h+1)),
+		sq:     make([]uint32, (w+1)*(h+1)),
+	}
+	for y := 0; y < h; y++ {
+		var rowSum, rowSq uint32
+		pi := y * im.Stride
+		above := y * ii.stride
+		out := above + ii.stride
+		for x := 0; x < w; x++ {
+			v := uint32(im.Pix[pi+x])
+			rowSum += v
+			rowSq += v * v
+			ii.sum[out+x+1] = ii.sum[above+x+1] + rowSum
+			ii.sq[out+x+1] = ii.sq[above+x+1] + rowSq
+		}
+	}
+	return ii
+}
+
+// window sums the pixels in [x0,x1) x [y0,y1)
+func (ii *integralImage) window(x0, y0, x1, y1 int) (sum, sq uint32) {
+	a := (y0 * ii.stride) + x0
+	b := (y0 * ii.stride) + x1
+	c := (y1 * ii.stride) + x0
+	d := (y1 * ii.stride) + x1
+	return ii.sum[d] - ii.sum[b] - ii.sum[c] + ii.sum[a], ii.sq[d] - ii.sq[b] - ii.sq[c] + ii.sq[a]
+}
+
+// adaptiveFlatten returns a copy of the scan with each pixel moved by the difference between its local threshold and flatThreshold,
+// so that the one threshold splits the copy as the local thresholds would the scan, and contrast is kept for grey level matching.
+func adaptiveFlatten(it *image.Gray, method ThresholdMethod) *image.Gray {
+	w := it.Rect.Dx()
+	h := it.Rect.Dy()
+	window := int(float64(imin(w, h)) * adaptiveWindowFraction)
+	if window > maxAdaptiveWindow {
+		window = maxAdaptiveWindow
+	}
+	half := window / 2
+	if half < 1 {
+		half = 1
+	}
+	ii := newIntegralImage(it)
+	out := image.NewGray(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		y0 := imax(0, y-half)
+		y1 := imin(h, y+half+1)
+		for x := 0; x < w; x++ {
+			x0 := imax(0, x-half)
+			x1 := imin(w, x+half+1)
+			sum, sq := ii.window(x0, y0, x1, y1)
+			n := float64((x1 - x0) * (y1 - y0))
+			mean := float64(sum) / n
+			dev := math.Sqrt(math.Max(0, (float64(sq)/n)-(mean*mean)))
+			var thresh float64
+			if method == ThresholdNiblack {
+				thresh = mean + (niblackK * math.Max(dev, niblackMinDeviation))
+			} else {
+				thresh = mean * (1 + (sauvolaK * ((dev / sauvolaR) - 1)))
+			}
+			v := float64(it.Pix[(y*it.Stride)+x])
+			// v < thresh exactly when the result < flatThreshold
+			out.Pix[(y*out.Stride)+x] = uint8(fclamp(math.Floor(v-thresh)+flatThreshold, 0, 255))
+		}
+	}
+	return out
+}
+
+func imin(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func imax(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
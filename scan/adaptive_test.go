@@ -0,0 +1,113 @@
+package scan
+
+import (
+	"image"
+	"image/png"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestIntegralImage(t *testing.T) {
+	im := image.NewGray(image.Rect(0, 0, 23, 17))
+	rnd := rand.New(rand.NewSource(1))
+	for i := range im.Pix {
+		im.Pix[i] = uint8(rnd.Intn(256))
+	}
+	ii := newIntegralImage(im)
+	for _, r := range []image.Rectangle{image.Rect(0, 0, 23, 17), image.Rect(3, 4, 11, 9), image.Rect(22, 16, 23, 17)} {
+		var wantSum, wantSq uint32
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			for x := r.Min.X; x < r.Max.X; x++ {
+				v := uint32(im.Pix[(y*im.Stride)+x])
+				wantSum += v
+				wantSq += v * v
+			}
+		}
+		sum, sq := ii.window(r.Min.X, r.Min.Y, r.Max.X, r.Max.Y)
+		if sum != wantSum || sq != wantSq {
+			t.Errorf("%v sum %d sq %d, want %d %d", r, sum, sq, wantSum, wantSq)
+		}
+	}
+}
+
+// A scan in the shadow of a fold: the left side of the page is darker than the ink on the right.
+func TestUnevenIllumination(t *testing.T) {
+	bj := synthBubbles()
+	orig := synthTemplate(&bj, 0)
+	synthBubble(orig, bj.Bubbles[0]["mayor"]["bob"], true)
+	scan := synthScan(orig, synthRotation(0.003, 12.4, 9.7), 30)
+	w := float64(scan.Rect.Dx())
+	for y := 0; y < scan.Rect.Dy(); y++ {
+		for x := 0; x < scan.Rect.Dx(); x++ {
+			light := 0.3 + (0.7 * float64(x) / w)
+			pi := (y * scan.Stride) + x
+			scan.Pix[pi] = uint8(float64(scan.Pix[pi]) * light)
+		}
+	}
+	tmpl, err := NewTemplate(&bj, synthTemplate(&bj, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]map[string]bool{
+		"mayor":   {"bob": true},
+		"council": {},
+	}
+
+	result, err := NewScanner(tmpl).ProcessScannedImage(scan)
+	if err == nil && reflect.DeepEqual(result.Marked(), want) {
+		t.Errorf("Otsu read the shadowed scan right, not shadowed enough for this test")
+	}
+	for _, method := range []ThresholdMethod{ThresholdSauvola, ThresholdNiblack} {
+		s := NewScanner(tmpl)
+		s.Threshold = method
+		result, err := s.ProcessScannedImage(scan)
+		if err != nil {
+			t.Errorf("threshold %d: %v", method, err)
+		} else if got := result.Marked(); !reflect.DeepEqual(got, want) {
+			t.Errorf("threshold %d: got %v, want %v", method, got, want)
+		}
+	}
+}
+
+// Adaptive thresholds decide dark and light, but the images people look at are still the scan itself.
+func TestAdaptiveKeepsScan(t *testing.T) {
+	bj := synthBubbles()
+	orig := synthTemplate(&bj, 0)
+	scan := synthScan(orig, synthRotation(0.003, 12.4, 9.7), 30)
+	tmpl, err := NewTemplate(&bj, orig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "adaptive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s := NewScanner(tmpl)
+	s.Threshold = ThresholdSauvola
+	s.DebugPngPath = filepath.Join(dir, "debug.png")
+	_, err = s.ProcessScannedImage(scan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fin, err := os.Open(s.DebugPngPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fin.Close()
+	im, err := png.Decode(fin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// blank paper between the text and the right border
+	m := int(bj.DrawSettings.PageMargin * synthPxPerPt)
+	x := orig.Rect.Max.X - m - 15
+	y := orig.Rect.Max.Y / 2
+	if v := colorY(im.At(x, y)); v < 240 {
+		t.Errorf("paper in debug image = %d, want the scan's white", v)
+	}
+}
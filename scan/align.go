@@ -31,6 +31,9 @@ diagonalize [biga | atb]
 // go get -u -t gonum.org/v1/gonum/...
 
 import (
+	"math"
+	"math/rand"
+
 	"gonum.org/v1/gonum/mat"
 )
 
@@ -79,3 +82,189 @@ func FindTransform(sources, dests []FPoint) []float64 {
 	//fmt.Printf("solution ?\nx = %v\n", mat.Formatted(&x))
 	return mat.Col(nil, 0, &x)
 }
+
+// FindHomography fits a perspective transform to four or more point pairs by least squares,
+// with the bottom right of the matrix fixed at 1. Returns nil if the points don't determine one.
+func FindHomography(sources, dests []FPoint) []float64 {
+	if len(sources) != len(dests) || len(sources) < 4 {
+		return nil
+	}
+	// dx = (a*sx + b*sy + c) / (g*sx + h*sy + 1), so
+	// a*sx + b*sy + c - g*sx*dx - h*sy*dx = dx
+	// d*sx + e*sy + f - g*sx*dy - h*sy*dy = dy
+	// solved for [a b c d e f g h] on points centered and scaled to about 1, so the solve is well conditioned
+	ns, sourceNorm := normalizePoints(sources)
+	nd, destNorm := normalizePoints(dests)
+	data := make([]float64, len(sources)*2*8)
+	dest := make([]float64, len(sources)*2)
+	for i, sp := range ns {
+		dp := nd[i]
+		rp := i * 2 * 8
+		data[rp+0] = sp.X
+		data[rp+1] = sp.Y
+		data[rp+2] = 1.0
+		data[rp+6] = -sp.X * dp.X
+		data[rp+7] = -sp.Y * dp.X
+		dest[i*2] = dp.X
+		rp += 8
+		data[rp+3] = sp.X
+		data[rp+4] = sp.Y
+		data[rp+5] = 1.0
+		data[rp+6] = -sp.X * dp.Y
+		data[rp+7] = -sp.Y * dp.Y
+		dest[(i*2)+1] = dp.Y
+	}
+	A := mat.NewDense(len(sources)*2, 8, data)
+	b := mat.NewDense(len(sources)*2, 1, dest)
+	var x mat.Dense
+	if err := x.Solve(A, b); err != nil {
+		return nil
+	}
+	normFit := mat.NewDense(3, 3, append(mat.Col(nil, 0, &x), 1.0))
+	// undo the normalization, destNorm^-1 . normFit . sourceNorm
+	var destDenorm, fit mat.Dense
+	if err := destDenorm.Inverse(destNorm); err != nil {
+		return nil
+	}
+	fit.Product(&destDenorm, normFit, sourceNorm)
+	out := make([]float64, 9)
+	for i := range out {
+		out[i] = fit.At(i/3, i%3) / fit.At(2, 2)
+	}
+	return out
+}
+
+// normalizePoints moves points to be centered on 0,0 at an average distance of sqrt(2),
+// and returns them with the matrix that does it.
+func normalizePoints(points []FPoint) ([]FPoint, *mat.Dense) {
+	var cx, cy float64
+	for _, p := range points {
+		cx += p.X
+		cy += p.Y
+	}
+	cx /= float64(len(points))
+	cy /= float64(len(points))
+	dist := 0.0
+	for _, p := range points {
+		dist += math.Hypot(p.X-cx, p.Y-cy)
+	}
+	dist /= float64(len(points))
+	scale := 1.0
+	if dist > 0 {
+		scale = math.Sqrt2 / dist
+	}
+	out := make([]FPoint, len(points))
+	for i, p := range points {
+		out[i] = FPoint{X: (p.X - cx) * scale, Y: (p.Y - cy) * scale}
+	}
+	return out, mat.NewDense(3, 3, []float64{
+		scale, 0, -cx * scale,
+		0, scale, -cy * scale,
+		0, 0, 1,
+	})
+}
+
+// RANSAC tries this many random minimal samples of point pairs
+const ransacIterations = 200
+
+// FindTransformRansac fits a transform to the largest set of point pairs that agree with each other,
+// so a few bad matches don't pull the fit. A pair is an inlier if the fitted transform puts its source
+// within maxError of its dest. Samples are drawn from a fixed seed, the same points always give the same fit.
+// Returns the least squares fit over the inliers, and which pairs they were.
+func FindTransformRansac(sources, dests []FPoint, maxError float64) (fit []float64, inliers []bool) {
+	inliers = make([]bool, len(sources))
+	if len(sources) != len(dests) {
+		return nil, inliers
+	}
+	if len(sources) <= 3 {
+		for i := range inliers {
+			inliers[i] = true
+		}
+		return FindTransform(sources, dests), inliers
+	}
+	rng := rand.New(rand.NewSource(1))
+	bestCount := 0
+	bestErr := 0.0
+	var sampleSources, sampleDests [3]FPoint
+	candidate := make([]bool, len(sources))
+	for iter := 0; iter < ransacIterations; iter++ {
+		a := rng.Intn(len(sources))
+		b := rng.Intn(len(sources) - 1)
+		if b >= a {
+			b++
+		}
+		c := rng.Intn(len(sources) - 2)
+		for _, v := range sortedPair(a, b) {
+			if c >= v {
+				c++
+			}
+		}
+		for i, pi := range []int{a, b, c} {
+			sampleSources[i] = sources[pi]
+			sampleDests[i] = dests[pi]
+		}
+		sample := FindTransform(sampleSources[:], sampleDests[:])
+		if !finiteMatrix(sample) {
+			// collinear
+			continue
+		}
+		count, sumErr := ransacInliers(sample, sources, dests, maxError, candidate)
+		if count > bestCount || (count == bestCount && sumErr < bestErr) {
+			bestCount = count
+			bestErr = sumErr
+			copy(inliers, candidate)
+		}
+	}
+	if bestCount < 3 {
+		for i := range inliers {
+			inliers[i] = true
+		}
+		return FindTransform(sources, dests), inliers
+	}
+	// refit on the inliers, which may gather a few more
+	for round := 0; round < 2; round++ {
+		fit = FindTransform(selectPoints(sources, inliers), selectPoints(dests, inliers))
+		if !finiteMatrix(fit) {
+			break
+		}
+		count, _ := ransacInliers(fit, sources, dests, maxError, candidate)
+		if count < bestCount {
+			break
+		}
+		bestCount = count
+		copy(inliers, candidate)
+	}
+	return FindTransform(selectPoints(sources, inliers), selectPoints(dests, inliers)), inliers
+}
+
+func sortedPair(a, b int) [2]int {
+	if a < b {
+		return [2]int{a, b}
+	}
+	return [2]int{b, a}
+}
+
+// ransacInliers marks the pairs that fit within maxError
+func ransacInliers(fit []float64, sources, dests []FPoint, maxError float64, inliers []bool) (count int, sumErr float64) {
+	mt := MatrixTransform{fit}
+	for i, sp := range sources {
+		x, y := mt.Transform(sp.X, sp.Y)
+		d := math.Hypot(x-dests[i].X, y-dests[i].Y)
+		inliers[i] = d <= maxError
+		if inliers[i] {
+			count++
+			sumErr += d
+		}
+	}
+	return
+}
+
+func selectPoints(points []FPoint, keep []bool) []FPoint {
+	out := make([]FPoint, 0, len(points))
+	for i, p := range points {
+		if keep[i] {
+			out = append(out, p)
+		}
+	}
+	return out
+}
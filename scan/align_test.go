@@ -0,0 +1,82 @@
+package scan
+
+import (
+	"math"
+	"testing"
+)
+
+func TestFindTransformRansac(t *testing.T) {
+	truth := MatrixTransform{[]float64{1.02, -0.01, 12.5, 0.012, 0.99, -7.25, 0, 0, 1}}
+	var sources, dests []FPoint
+	for y := 50; y < 1600; y += 350 {
+		for x := 50; x < 1200; x += 300 {
+			sx, sy := truth.Transform(float64(x), float64(y))
+			sources = append(sources, FPointFromInt(x, y))
+			dests = append(dests, FPoint{sx, sy})
+		}
+	}
+	// matches that landed on a mark or a fold
+	bad := map[int]bool{1: true, 6: true, 13: true}
+	for i := range bad {
+		dests[i].X += 9
+		dests[i].Y -= 14
+	}
+
+	fit, inliers := FindTransformRansac(sources, dests, 2.0)
+	for i, inlier := range inliers {
+		if inlier == bad[i] {
+			t.Errorf("point %d inlier=%v", i, inlier)
+		}
+	}
+	fitErr := func(fit []float64) float64 {
+		worst := 0.0
+		mt := MatrixTransform{fit}
+		for _, sp := range sources {
+			fx, fy := mt.Transform(sp.X, sp.Y)
+			tx, ty := truth.Transform(sp.X, sp.Y)
+			worst = fmax(worst, math.Hypot(fx-tx, fy-ty))
+		}
+		return worst
+	}
+	if e := fitErr(fit); e > 1e-6 {
+		t.Errorf("ransac fit off by %f px", e)
+	}
+	if e := fitErr(FindTransform(sources, dests)); e < 1 {
+		t.Errorf("least squares over everything only off by %f px, outliers too weak for this test", e)
+	}
+
+	again, _ := FindTransformRansac(sources, dests, 2.0)
+	for i := range fit {
+		if fit[i] != again[i] {
+			t.Errorf("not reproducible: %v != %v", fit, again)
+			break
+		}
+	}
+}
+
+func TestFindHomography(t *testing.T) {
+	truth := MatrixTransform{[]float64{1.03, 0.004, 20, -0.006, 0.985, 15, 1e-6, 2e-5, 1}}
+	var sources, dests []FPoint
+	for _, sp := range []FPoint{{75, 75}, {1200, 75}, {1200, 1575}, {75, 1575}} {
+		dx, dy := truth.Transform(sp.X, sp.Y)
+		sources = append(sources, sp)
+		dests = append(dests, FPoint{dx, dy})
+	}
+	fit := FindHomography(sources, dests)
+	if !finiteMatrix(fit) {
+		t.Fatalf("no fit %v", fit)
+	}
+	mt := MatrixTransform{fit}
+	for y := 0.0; y < 1650; y += 150 {
+		for x := 0.0; x < 1275; x += 150 {
+			fx, fy := mt.Transform(x, y)
+			tx, ty := truth.Transform(x, y)
+			if d := math.Hypot(fx-tx, fy-ty); d > 1e-6 {
+				t.Errorf("(%f,%f) off by %f px", x, y, d)
+			}
+		}
+	}
+	if FindHomography(sources[:3], dests[:3]) != nil {
+		t.Errorf("fit from three points")
+	}
+}
@@ -0,0 +1,502 @@
+package scan
+
+import (
+	"image"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// BarcodeSettings describes where a ballot's barcode is printed and what it means.
+type BarcodeSettings struct {
+	// [x,y, width,height] in points from the bottom left of the page, like bubbles
+	Rect []float64 `json:"rect"`
+
+	// "code128", "i2of5", "code39", or empty to try all of them
+	Symbology string `json:"symbology,omitempty"`
+
+	// Where each value is in the decoded text, [start, length].
+	// A length <= 0 runs to the end of the text.
+	// The style value is an index into BubblesJson.Bubbles.
+	Style    []int `json:"style,omitempty"`
+	Precinct []int `json:"precinct,omitempty"`
+	Serial   []int `json:"serial,omitempty"`
+
+	// Length is how many characters the decoded text has, including any check digit. 0 accepts any length.
+	Length int `json:"length,omitempty"`
+
+	// CheckDigit is true if the last digit of an i2of5 barcode is a mod 10 check digit over the others.
+	CheckDigit bool `json:"checkDigit,omitempty"`
+}
+
+// accepts is false for text that can't be what bs describes, a partial read.
+func (bs *BarcodeSettings) accepts(symbology, text string) bool {
+	if bs.Length > 0 && len(text) != bs.Length {
+		return false
+	}
+	if bs.CheckDigit && symbology == SymbologyI2of5 && !i2of5CheckDigitOk(text) {
+		return false
+	}
+	return true
+}
+
+// i2of5Trusted is false for an i2of5 read with neither Length nor CheckDigit to check it by.
+// A scan line across only part of an i2of5 barcode can decode as a shorter run of other digits.
+func (bs *BarcodeSettings) i2of5Trusted() bool {
+	return bs.Length > 0 || bs.CheckDigit
+}
+
+// i2of5CheckDigitOk checks the last digit of text against the others, weighted 3,1,3,... leftward from it
+func i2of5CheckDigitOk(text string) bool {
+	if len(text) < 2 {
+		return false
+	}
+	sum := 0
+	weight := 3
+	for i := len(text) - 2; i >= 0; i-- {
+		sum += int(text[i]-'0') * weight
+		weight = 4 - weight
+	}
+	return int(text[len(text)-1]-'0') == (10-(sum%10))%10
+}
+
+const (
+	SymbologyCode128 = "code128"
+	SymbologyI2of5   = "i2of5"
+	SymbologyCode39  = "code39"
+)
+
+// BarcodeResult is what was read from a ballot's barcode.
+type BarcodeResult struct {
+	Symbology string `json:"symbology"`
+	Text      string `json:"text"`
+
+	// Style is the ballot style index from the barcode, -1 if not encoded, not a number,
+	// or read from an i2of5 barcode with no BarcodeSettings.Length or CheckDigit to check it by
+	Style    int    `json:"style"`
+	Precinct string `json:"precinct,omitempty"`
+	Serial   string `json:"serial,omitempty"`
+
+	// how many of the sampled scan lines agreed on Text
+	Lines int `json:"lines"`
+}
+
+func barcodeField(text string, field []int) string {
+	if len(field) == 0 {
+		return ""
+	}
+	start := field[0]
+	if start < 0 || start >= len(text) {
+		return ""
+	}
+	end := len(text)
+	if len(field) > 1 && field[1] > 0 && start+field[1] < end {
+		end = start + field[1]
+	}
+	return text[start:end]
+}
+
+// number of scan lines sampled across the barcode region
+const barcodeLines = 9
+
+// sample step along a barcode scan line, in orig png pixels
+const barcodeStep = 0.25
+
+// minimum luminance range along a scan line to try decoding it
+const barcodeMinContrast = 40
+
+// readBarcode samples horizontal lines through the barcode region of the scan and decodes them.
+// The text most scan lines agree on wins. Returns nil if there is no barcode region or nothing decoded.
+func (s *Scanner) readBarcode(it *image.Gray) *BarcodeResult {
+	if s.t.bj.DrawSettings == nil || s.t.bj.DrawSettings.Barcode == nil {
+		return nil
+	}
+	bs := s.t.bj.DrawSettings.Barcode
+	if len(bs.Rect) < 4 {
+		return nil
+	}
+	rect := s.t.pxRect(bs.Rect)
+	left := rect.x
+	width := rect.w
+	bottom := rect.y + rect.h
+	height := rect.h
+
+	nsamples := int(width / barcodeStep)
+	line := make([]float64, nsamples)
+	votes := make(map[[2]string]int)
+	for li := 0; li < barcodeLines; li++ {
+		// spread lines over the middle 60% of the region
+		oy := bottom - (height * (0.2 + (0.6 * float64(li) / float64(barcodeLines-1))))
+		for i := range line {
+			sx, sy := s.origToScanned.Transform(left+(float64(i)*barcodeStep), oy)
+			line[i] = float64(s.sample(it, sx, sy))
+		}
+		symbology, text, ok := decodeBarcodeLine(line, bs.Symbology)
+		if ok && bs.accepts(symbology, text) {
+			votes[[2]string{symbology, text}]++
+		}
+	}
+	if len(votes) == 0 {
+		s.debug("barcode: no decode\n")
+		return nil
+	}
+	var best [2]string
+	bestCount := 0
+	for k, count := range votes {
+		if count > bestCount || (count == bestCount && k[1] < best[1]) {
+			best = k
+			bestCount = count
+		}
+	}
+	br := &BarcodeResult{
+		Symbology: best[0],
+		Text:      best[1],
+		Style:     -1,
+		Precinct:  barcodeField(best[1], bs.Precinct),
+		Serial:    barcodeField(best[1], bs.Serial),
+		Lines:     bestCount,
+	}
+	if br.Symbology == SymbologyI2of5 && !bs.i2of5Trusted() {
+		s.debug("barcode: i2of5 with no length or check digit, not taking style from it\n")
+	} else if sv := barcodeField(best[1], bs.Style); sv != "" {
+		style, err := strconv.Atoi(sv)
+		if err == nil {
+			br.Style = style
+		}
+	}
+	s.debug("barcode %s %#v (%d/%d lines)\n", br.Symbology, br.Text, bestCount, barcodeLines)
+	return br
+}
+
+// decodeBarcodeLine thresholds a line of luminance samples into bar/space widths and tries each symbology on them, forwards then backwards.
+func decodeBarcodeLine(line []float64, symbology string) (foundSymbology, text string, ok bool) {
+	runs := barcodeRuns(line)
+	if len(runs) < 7 {
+		return "", "", false
+	}
+	reversed := make([]float64, len(runs))
+	for i, w := range runs {
+		reversed[len(runs)-1-i] = w
+	}
+	for _, r := range [][]float64{runs, reversed} {
+		if symbology == "" || symbology == SymbologyCode128 {
+			if text, ok = decodeCode128(r); ok {
+				return SymbologyCode128, text, true
+			}
+		}
+		if symbology == "" || symbology == SymbologyI2of5 {
+			if text, ok = decodeI2of5(r); ok {
+				return SymbologyI2of5, text, true
+			}
+		}
+		if symbology == "" || symbology == SymbologyCode39 {
+			if text, ok = decodeCode39(r); ok {
+				return SymbologyCode39, text, true
+			}
+		}
+	}
+	return "", "", false
+}
+
+// barcodeRuns returns alternating bar,space,bar... widths from the first dark sample to the last.
+// Edges are placed where the signal crosses a threshold halfway between the line's darkest and lightest values,
+// interpolated between samples so widths have sub-sample precision.
+func barcodeRuns(line []float64) []float64 {
+	min := 255.0
+	max := 0.0
+	for _, v := range line {
+		min = math.Min(min, v)
+		max = math.Max(max, v)
+	}
+	if max-min < barcodeMinContrast {
+		return nil
+	}
+	thresh := (min + max) / 2
+	edges := make([]float64, 0, 100)
+	for i := 1; i < len(line); i++ {
+		a := line[i-1]
+		b := line[i]
+		if (a < thresh) != (b < thresh) {
+			edges = append(edges, float64(i-1)+((thresh-a)/(b-a)))
+		}
+	}
+	if len(line) > 0 && line[0] < thresh {
+		// starts inside a bar, it's clipped, drop it
+		if len(edges) > 0 {
+			edges = edges[1:]
+		}
+	}
+	// edges alternate light->dark, dark->light, ...
+	if len(edges)%2 == 1 {
+		// ends inside a bar, clipped
+		edges = edges[:len(edges)-1]
+	}
+	if len(edges) < 2 {
+		return nil
+	}
+	runs := make([]float64, len(edges)-1)
+	for i := range runs {
+		runs[i] = edges[i+1] - edges[i]
+	}
+	return runs
+}
+
+// wideElements returns a bitmask, most significant bit first, marking the nwide widest of the widths.
+// ok is false if wide and narrow aren't clearly separated.
+func wideElements(widths []float64, nwide int) (bits uint, ok bool) {
+	sorted := make([]float64, len(widths))
+	copy(sorted, widths)
+	sort.Float64s(sorted)
+	widestNarrow := sorted[len(sorted)-nwide-1]
+	narrowestWide := sorted[len(sorted)-nwide]
+	if narrowestWide < widestNarrow*1.5 {
+		return 0, false
+	}
+	cut := (widestNarrow + narrowestWide) / 2
+	for _, w := range widths {
+		bits <<= 1
+		if w > cut {
+			bits |= 1
+		}
+	}
+	return bits, true
+}
+
+const code39Alphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ-. $/+%*"
+
+// 9 elements bar,space,bar..., 1 = wide, in the order of code39Alphabet
+var code39Patterns = []uint{
+	0x034, 0x121, 0x061, 0x160, 0x031, 0x130, 0x070, 0x025, 0x124, 0x064, // 0-9
+	0x109, 0x049, 0x148, 0x019, 0x118, 0x058, 0x00D, 0x10C, 0x04C, 0x01C, // A-J
+	0x103, 0x043, 0x142, 0x013, 0x112, 0x052, 0x007, 0x106, 0x046, 0x016, // K-T
+	0x181, 0x0C1, 0x1C0, 0x091, 0x190, 0x0D0, 0x085, 0x184, 0x0C4, 0x0A8, // U-$
+	0x0A2, 0x08A, 0x02A, 0x094, // /+%*
+}
+
+func decodeCode39Char(widths []float64) (byte, bool) {
+	bits, ok := wideElements(widths, 3)
+	if !ok {
+		return 0, false
+	}
+	for i, p := range code39Patterns {
+		if p == bits {
+			return code39Alphabet[i], true
+		}
+	}
+	return 0, false
+}
+
+// decodeCode39 reads *TEXT* from runs, each character 9 elements plus a narrow gap.
+func decodeCode39(runs []float64) (string, bool) {
+	if (len(runs)+1)%10 != 0 || len(runs) < 29 {
+		return "", false
+	}
+	text := make([]byte, 0, len(runs)/10)
+	for i := 0; i+9 <= len(runs); i += 10 {
+		c, ok := decodeCode39Char(runs[i : i+9])
+		if !ok {
+			return "", false
+		}
+		text = append(text, c)
+	}
+	last := len(text) - 1
+	if text[0] != '*' || text[last] != '*' {
+		return "", false
+	}
+	text = text[1:last]
+	for _, c := range text {
+		if c == '*' {
+			return "", false
+		}
+	}
+	return string(text), true
+}
+
+// 5 elements, 1 = wide, for digits 0-9
+var i2of5Patterns = []uint{
+	0x06, 0x11, 0x09, 0x18, 0x05, 0x14, 0x0C, 0x03, 0x12, 0x0A,
+}
+
+func i2of5Digit(widths []float64) (byte, bool) {
+	bits, ok := wideElements(widths, 2)
+	if !ok {
+		return 0, false
+	}
+	for i, p := range i2of5Patterns {
+		if p == bits {
+			return byte('0' + i), true
+		}
+	}
+	return 0, false
+}
+
+// decodeI2of5 reads Interleaved 2 of 5: start nnnn, digit pairs with the first digit in the bars and the second in the spaces, stop wnn.
+func decodeI2of5(runs []float64) (string, bool) {
+	if len(runs) < 17 || (len(runs)-7)%10 != 0 {
+		return "", false
+	}
+	// start pattern, four narrow
+	narrow := (runs[0] + runs[1] + runs[2] + runs[3]) / 4
+	for _, w := range runs[:4] {
+		if w > narrow*1.5 {
+			return "", false
+		}
+	}
+	// stop pattern, wide bar narrow space narrow bar
+	stop := runs[len(runs)-3:]
+	if stop[0] < math.Max(stop[1], stop[2])*1.5 {
+		return "", false
+	}
+	text := make([]byte, 0, (len(runs)-7)/5)
+	var bars, spaces [5]float64
+	for i := 4; i+10 <= len(runs)-3; i += 10 {
+		for j := 0; j < 5; j++ {
+			bars[j] = runs[i+(j*2)]
+			spaces[j] = runs[i+(j*2)+1]
+		}
+		a, ok := i2of5Digit(bars[:])
+		if !ok {
+			return "", false
+		}
+		b, ok := i2of5Digit(spaces[:])
+		if !ok {
+			return "", false
+		}
+		text = append(text, a, b)
+	}
+	return string(text), true
+}
+
+// 6 element widths in modules, by symbol value. 103,104,105 are Start A,B,C.
+var code128Patterns = [][6]uint8{
+	{2, 1, 2, 2, 2, 2}, {2, 2, 2, 1, 2, 2}, {2, 2, 2, 2, 2, 1}, {1, 2, 1, 2, 2, 3}, {1, 2, 1, 3, 2, 2},
+	{1, 3, 1, 2, 2, 2}, {1, 2, 2, 2, 1, 3}, {1, 2, 2, 3, 1, 2}, {1, 3, 2, 2, 1, 2}, {2, 2, 1, 2, 1, 3},
+	{2, 2, 1, 3, 1, 2}, {2, 3, 1, 2, 1, 2}, {1, 1, 2, 2, 3, 2}, {1, 2, 2, 1, 3, 2}, {1, 2, 2, 2, 3, 1},
+	{1, 1, 3, 2, 2, 2}, {1, 2, 3, 1, 2, 2}, {1, 2, 3, 2, 2, 1}, {2, 2, 3, 2, 1, 1}, {2, 2, 1, 1, 3, 2},
+	{2, 2, 1, 2, 3, 1}, {2, 1, 3, 2, 1, 2}, {2, 2, 3, 1, 1, 2}, {3, 1, 2, 1, 3, 1}, {3, 1, 1, 2, 2, 2},
+	{3, 2, 1, 1, 2, 2}, {3, 2, 1, 2, 2, 1}, {3, 1, 2, 2, 1, 2}, {3, 2, 2, 1, 1, 2}, {3, 2, 2, 2, 1, 1},
+	{2, 1, 2, 1, 2, 3}, {2, 1, 2, 3, 2, 1}, {2, 3, 2, 1, 2, 1}, {1, 1, 1, 3, 2, 3}, {1, 3, 1, 1, 2, 3},
+	{1, 3, 1, 3, 2, 1}, {1, 1, 2, 3, 1, 3}, {1, 3, 2, 1, 1, 3}, {1, 3, 2, 3, 1, 1}, {2, 1, 1, 3, 1, 3},
+	{2, 3, 1, 1, 1, 3}, {2, 3, 1, 3, 1, 1}, {1, 1, 2, 1, 3, 3}, {1, 1, 2, 3, 3, 1}, {1, 3, 2, 1, 3, 1},
+	{1, 1, 3, 1, 2, 3}, {1, 1, 3, 3, 2, 1}, {1, 3, 3, 1, 2, 1}, {3, 1, 3, 1, 2, 1}, {2, 1, 1, 3, 3, 1},
+	{2, 3, 1, 1, 3, 1}, {2, 1, 3, 1, 1, 3}, {2, 1, 3, 3, 1, 1}, {2, 1, 3, 1, 3, 1}, {3, 1, 1, 1, 2, 3},
+	{3, 1, 1, 3, 2, 1}, {3, 3, 1, 1, 2, 1}, {3, 1, 2, 1, 1, 3}, {3, 1, 2, 3, 1, 1}, {3, 3, 2, 1, 1, 1},
+	{3, 1, 4, 1, 1, 1}, {2, 2, 1, 4, 1, 1}, {4, 3, 1, 1, 1, 1}, {1, 1, 1, 2, 2, 4}, {1, 1, 1, 4, 2, 2},
+	{1, 2, 1, 1, 2, 4}, {1, 2, 1, 4, 2, 1}, {1, 4, 1, 1, 2, 2}, {1, 4, 1, 2, 2, 1}, {1, 1, 2, 2, 1, 4},
+	{1, 1, 2, 4, 1, 2}, {1, 2, 2, 1, 1, 4}, {1, 2, 2, 4, 1, 1}, {1, 4, 2, 1, 1, 2}, {1, 4, 2, 2, 1, 1},
+	{2, 4, 1, 2, 1, 1}, {2, 2, 1, 1, 1, 4}, {4, 1, 3, 1, 1, 1}, {2, 4, 1, 1, 1, 2}, {1, 3, 4, 1, 1, 1},
+	{1, 1, 1, 2, 4, 2}, {1, 2, 1, 1, 4, 2}, {1, 2, 1, 2, 4, 1}, {1, 1, 4, 2, 1, 2}, {1, 2, 4, 1, 1, 2},
+	{1, 2, 4, 2, 1, 1}, {4, 1, 1, 2, 1, 2}, {4, 2, 1, 1, 1, 2}, {4, 2, 1, 2, 1, 1}, {2, 1, 2, 1, 4, 1},
+	{2, 1, 4, 1, 2, 1}, {4, 1, 2, 1, 2, 1}, {1, 1, 1, 1, 4, 3}, {1, 1, 1, 3, 4, 1}, {1, 3, 1, 1, 4, 1},
+	{1, 1, 4, 1, 1, 3}, {1, 1, 4, 3, 1, 1}, {4, 1, 1, 1, 1, 3}, {4, 1, 1, 3, 1, 1}, {1, 1, 3, 1, 4, 1},
+	{1, 1, 4, 1, 3, 1}, {3, 1, 1, 1, 4, 1}, {4, 1, 1, 1, 3, 1}, {2, 1, 1, 4, 1, 2}, {2, 1, 1, 2, 1, 4},
+	{2, 1, 1, 2, 3, 2},
+}
+
+var code128Stop = [7]uint8{2, 3, 3, 1, 1, 1, 2}
+
+const (
+	code128Shift  = 98
+	code128CodeC  = 99
+	code128CodeB  = 100
+	code128CodeA  = 101
+	code128StartA = 103
+	code128StartB = 104
+	code128StartC = 105
+)
+
+// code128Symbol finds the symbol value whose module widths best match 6 element widths.
+func code128Symbol(widths []float64) (int, bool) {
+	total := 0.0
+	for _, w := range widths {
+		total += w
+	}
+	module := total / 11
+	best := -1
+	bestErr := 0.0
+	for v, p := range code128Patterns {
+		err := 0.0
+		for i, m := range p {
+			err += math.Abs((widths[i] / module) - float64(m))
+		}
+		if best < 0 || err < bestErr {
+			best = v
+			bestErr = err
+		}
+	}
+	// allow about half a module of total error spread over the symbol
+	if bestErr > 1.5 {
+		return 0, false
+	}
+	return best, true
+}
+
+// decodeCode128 reads start, data symbols, mod 103 check symbol and stop.
+func decodeCode128(runs []float64) (string, bool) {
+	if len(runs) < 6*3+7 || (len(runs)-7)%6 != 0 {
+		return "", false
+	}
+	stop := runs[len(runs)-7:]
+	total := 0.0
+	for _, w := range stop {
+		total += w
+	}
+	module := total / 13
+	for i, m := range code128Stop {
+		if math.Abs((stop[i]/module)-float64(m)) > 0.6 {
+			return "", false
+		}
+	}
+	nsym := (len(runs) - 7) / 6
+	values := make([]int, nsym)
+	for i := range values {
+		v, ok := code128Symbol(runs[i*6 : (i*6)+6])
+		if !ok {
+			return "", false
+		}
+		values[i] = v
+	}
+	if values[0] < code128StartA || values[0] > code128StartC {
+		return "", false
+	}
+	check := values[0]
+	for i := 1; i < nsym-1; i++ {
+		check += i * values[i]
+	}
+	if check%103 != values[nsym-1] {
+		return "", false
+	}
+
+	codeSet := values[0] - code128StartA // 0=A, 1=B, 2=C
+	text := make([]byte, 0, nsym*2)
+	shift := false
+	for _, v := range values[1 : nsym-1] {
+		set := codeSet
+		if shift {
+			// shift swaps A and B for one symbol
+			set = 1 - codeSet
+			shift = false
+		}
+		switch {
+		case set == 2 && v < 100:
+			text = append(text, byte('0'+(v/10)), byte('0'+(v%10)))
+		case set != 2 && v < 64:
+			text = append(text, byte(' '+v))
+		case set == 0 && v < 96:
+			text = append(text, byte(v-64))
+		case set == 1 && v < 96:
+			text = append(text, byte(' '+v))
+		case v == code128Shift && set != 2:
+			shift = true
+		case v == code128CodeC:
+			codeSet = 2
+		case v == code128CodeB && set != 1:
+			codeSet = 1
+		case v == code128CodeA && set != 0:
+			codeSet = 0
+		default:
+			// FNC1-4 carry no text
+		}
+	}
+	return string(text), true
+}
@@ -0,0 +1,167 @@
+package scan
+
+import (
+	"strings"
+	"testing"
+)
+
+// element widths in modules, bar first
+func code39Widths(text string) []float64 {
+	out := make([]float64, 0, 100)
+	for i, c := range "*" + text + "*" {
+		if i > 0 {
+			out = append(out, 1) // inter-character gap
+		}
+		p := code39Patterns[strings.IndexRune(code39Alphabet, c)]
+		for bit := 8; bit >= 0; bit-- {
+			if p&(1<<uint(bit)) != 0 {
+				out = append(out, 3)
+			} else {
+				out = append(out, 1)
+			}
+		}
+	}
+	return out
+}
+
+func i2of5Widths(digits string) []float64 {
+	out := []float64{1, 1, 1, 1}
+	for i := 0; i+1 < len(digits); i += 2 {
+		a := i2of5Patterns[digits[i]-'0']
+		b := i2of5Patterns[digits[i+1]-'0']
+		for bit := 4; bit >= 0; bit-- {
+			for _, p := range []uint{a, b} {
+				if p&(1<<uint(bit)) != 0 {
+					out = append(out, 3)
+				} else {
+					out = append(out, 1)
+				}
+			}
+		}
+	}
+	return append(out, 3, 1, 1)
+}
+
+// code set C, even number of digits
+func code128Widths(digits string) []float64 {
+	values := []int{code128StartC}
+	for i := 0; i+1 < len(digits); i += 2 {
+		values = append(values, int(digits[i]-'0')*10+int(digits[i+1]-'0'))
+	}
+	check := values[0]
+	for i := 1; i < len(values); i++ {
+		check += i * values[i]
+	}
+	values = append(values, check%103)
+	out := make([]float64, 0, len(values)*6+7)
+	for _, v := range values {
+		for _, m := range code128Patterns[v] {
+			out = append(out, float64(m))
+		}
+	}
+	for _, m := range code128Stop {
+		out = append(out, float64(m))
+	}
+	return out
+}
+
+// renderBarcodeLine draws widths at moduleWidth samples per module with quiet zones,
+// area-sampling each sample so edges land between samples like a real scan.
+func renderBarcodeLine(widths []float64, moduleWidth float64) []float64 {
+	quiet := 10 * moduleWidth
+	total := quiet * 2
+	for _, w := range widths {
+		total += w * moduleWidth
+	}
+	line := make([]float64, int(total))
+	for i := range line {
+		line[i] = 230
+	}
+	pos := quiet
+	for wi, w := range widths {
+		end := pos + (w * moduleWidth)
+		if wi%2 == 0 {
+			for i := int(pos); i < len(line) && float64(i) < end; i++ {
+				// dark coverage of sample [i,i+1)
+				cover := fmin(end, float64(i+1)) - fmax(pos, float64(i))
+				line[i] -= 200 * cover
+			}
+		}
+		pos = end
+	}
+	return line
+}
+
+func fmin(a, b float64) float64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func TestDecodeBarcodeLine(t *testing.T) {
+	cases := []struct {
+		symbology string
+		text      string
+		widths    []float64
+	}{
+		{SymbologyCode39, "S2P0042N1234", code39Widths("S2P0042N1234")},
+		{SymbologyI2of5, "020042001234", i2of5Widths("020042001234")},
+		{SymbologyCode128, "020042001234", code128Widths("020042001234")},
+	}
+	for _, tc := range cases {
+		for _, moduleWidth := range []float64{2.3, 3.7, 6.1} {
+			line := renderBarcodeLine(tc.widths, moduleWidth)
+			symbology, text, ok := decodeBarcodeLine(line, "")
+			if !ok || symbology != tc.symbology || text != tc.text {
+				t.Errorf("%s at %.1f: got %v %s %#v", tc.symbology, moduleWidth, ok, symbology, text)
+			}
+			// upside down
+			for i, j := 0, len(line)-1; i < j; i, j = i+1, j-1 {
+				line[i], line[j] = line[j], line[i]
+			}
+			symbology, text, ok = decodeBarcodeLine(line, tc.symbology)
+			if !ok || symbology != tc.symbology || text != tc.text {
+				t.Errorf("%s reversed at %.1f: got %v %s %#v", tc.symbology, moduleWidth, ok, symbology, text)
+			}
+		}
+	}
+}
+
+func TestBarcodeField(t *testing.T) {
+	text := "020042001234"
+	if v := barcodeField(text, []int{0, 2}); v != "02" {
+		t.Errorf("style got %#v", v)
+	}
+	if v := barcodeField(text, []int{8, 0}); v != "1234" {
+		t.Errorf("serial got %#v", v)
+	}
+	if v := barcodeField(text, nil); v != "" {
+		t.Errorf("empty got %#v", v)
+	}
+}
+
+func TestBarcodeAccepts(t *testing.T) {
+	cases := []struct {
+		bs        BarcodeSettings
+		symbology string
+		text      string
+		ok        bool
+	}{
+		{BarcodeSettings{}, SymbologyI2of5, "01", true},
+		{BarcodeSettings{Length: 6}, SymbologyI2of5, "010042", true},
+		{BarcodeSettings{Length: 6}, SymbologyI2of5, "0100", false},
+		{BarcodeSettings{Length: 6}, SymbologyCode39, "S2P0042", false},
+		{BarcodeSettings{CheckDigit: true}, SymbologyI2of5, "012345678905", true},
+		{BarcodeSettings{CheckDigit: true}, SymbologyI2of5, "012345678904", false},
+		{BarcodeSettings{CheckDigit: true}, SymbologyI2of5, "0147", true},
+		{BarcodeSettings{CheckDigit: true}, SymbologyI2of5, "5", false},
+		// check digits are only for i2of5
+		{BarcodeSettings{CheckDigit: true}, SymbologyCode128, "0142", true},
+	}
+	for _, tc := range cases {
+		if ok := tc.bs.accepts(tc.symbology, tc.text); ok != tc.ok {
+			t.Errorf("%+v %s %#v: got %v", tc.bs, tc.symbology, tc.text, ok)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package scan
+
+import (
+	"image"
+	"math"
+)
+
+// sides of the page border
+const (
+	borderTop = iota
+	borderRight
+	borderBottom
+	borderLeft
+)
+
+var borderSideNames = [4]string{"top", "right", "bottom", "left"}
+
+// borderLine is one side of the page border. The top and bottom are y = slope*x + intercept
+// and the left and right are x = slope*y + intercept, so no side is near vertical in its own terms.
+type borderLine struct {
+	slope     float64
+	intercept float64
+}
+
+// a border edge point further than this from the first fit, in pixels, is dirt or a corner and is dropped before fitting again
+const maxBorderPointDistance = 3.0
+
+// fitBorder finds one side of the page border, searching in from that edge of the image every 50 pixels along it.
+func fitBorder(it *image.Gray, side int, threshold uint8) (line borderLine, err error) {
+	if err = lineFindable(it); err != nil {
+		return line, err
+	}
+	width := it.Rect.Max.X
+	height := it.Rect.Max.Y
+	length := width
+	if side == borderLeft || side == borderRight {
+		length = height
+	}
+	misscount := 0
+	hitcount := 0
+	// x is along the side and y across it
+	points := make([]point, 0, 100)
+	for along := 100; along < length-100; along += 50 {
+		var across int
+		var hit bool
+		switch side {
+		case borderTop:
+			across = yTopLineFind(it, along, threshold)
+			hit = across < height/2
+		case borderBottom:
+			across = yBottomLineFind(it, along, threshold)
+			hit = across > height/2
+		case borderLeft:
+			across = yLeftLineFind(it, along, threshold)
+			hit = across < width/2
+		case borderRight:
+			across = yRightLineFind(it, along, threshold)
+			hit = across > width/2
+		}
+		if hit {
+			points = append(points, point{along, across})
+			hitcount++
+		} else {
+			misscount++
+		}
+	}
+	name := borderSideNames[side]
+	if len(points) < 2 {
+		return line, newError(ReasonNoTopBorder, nil, "no %s line found, %d hit %d miss", name, hitcount, misscount)
+	}
+	if hitcount < misscount {
+		return line, newError(ReasonNoTopBorder, nil, "%s line mostly missing, %d hit %d miss", name, hitcount, misscount)
+	}
+	line.slope, line.intercept = ordinaryLeastSquares(points)
+	kept := make([]point, 0, len(points))
+	for _, pt := range points {
+		if pointLineDistance(line.slope, line.intercept, pt.x, pt.y) <= maxBorderPointDistance {
+			kept = append(kept, pt)
+		}
+	}
+	if len(kept) < 2 || len(kept) < hitcount/2 {
+		return line, newError(ReasonNoTopBorder, nil, "%s line ragged, %d of %d points on it", name, len(kept), hitcount)
+	}
+	line.slope, line.intercept = ordinaryLeastSquares(kept)
+	if math.Abs(line.slope) > maxTopLineSlope {
+		return line, newError(ReasonNoTopBorder, nil, "%s line too steep, slope=%f", name, line.slope)
+	}
+	return line, nil
+}
+
+// borderCorner is where a top or bottom line crosses a left or right line
+func borderCorner(horizontal, vertical borderLine) FPoint {
+	// y = a*x + b and x = c*y + d, so x = c*(a*x + b) + d
+	x := ((vertical.slope * horizontal.intercept) + vertical.intercept) / (1 - (vertical.slope * horizontal.slope))
+	return FPoint{X: x, Y: (horizontal.slope * x) + horizontal.intercept}
+}
+
+// findBorderCorners finds all four sides of the page border and returns where they meet,
+// top left, top right, bottom right, bottom left.
+func findBorderCorners(it *image.Gray, threshold uint8) ([]FPoint, error) {
+	var lines [4]borderLine
+	for side := range lines {
+		var err error
+		lines[side], err = fitBorder(it, side, threshold)
+		if err != nil {
+			return nil, err
+		}
+	}
+	corners := []FPoint{
+		borderCorner(lines[borderTop], lines[borderLeft]),
+		borderCorner(lines[borderTop], lines[borderRight]),
+		borderCorner(lines[borderBottom], lines[borderRight]),
+		borderCorner(lines[borderBottom], lines[borderLeft]),
+	}
+	// the border encloses most of the page
+	minWidth := float64(it.Rect.Max.X) / 2
+	minHeight := float64(it.Rect.Max.Y) / 2
+	if corners[1].X-corners[0].X < minWidth || corners[2].X-corners[3].X < minWidth ||
+		corners[3].Y-corners[0].Y < minHeight || corners[2].Y-corners[1].Y < minHeight {
+		return nil, newError(ReasonNoTopBorder, nil, "border corners %v enclose too little of %v", corners, it.Rect)
+	}
+	return corners, nil
+}
+
+// borderTransform sets origToScanned to the perspective transform taking the template's border corners to the scan's.
+// Unlike the top line alone it starts out right for a scan stretched more one way than the other, or keystoned.
+func (s *Scanner) borderTransform(it *image.Gray) error {
+	corners, err := findBorderCorners(it, s.scanThresh)
+	if err != nil {
+		return err
+	}
+	s.debug("border corners %v\n", corners)
+	fit := FindHomography(s.t.corners, corners)
+	if !finiteMatrix(fit) {
+		return newError(ReasonAlignmentDiverged, nil, "no transform from border corners %v to %v", s.t.corners, corners)
+	}
+	s.origToScanned = MatrixTransform{fit}
+	return nil
+}
+
+// initialTransform makes the first estimate of where the template is on the scan,
+// from all four page borders if it can and from the top border otherwise.
+func (s *Scanner) initialTransform(it *image.Gray) error {
+	if s.t.corners != nil {
+		err := s.borderTransform(it)
+		if err == nil {
+			return nil
+		}
+		s.debug("%v, trying top line\n", err)
+	}
+	return s.topLine(it)
+}
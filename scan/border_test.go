@@ -0,0 +1,81 @@
+package scan
+
+import (
+	"image"
+	"math"
+	"testing"
+)
+
+// worst distance in scan pixels between two transforms over the template page inside the border
+func transformDistance(a, b AffineTransform, tmpl *Template) float64 {
+	worst := 0.0
+	m := tmpl.topLeft.x
+	for y := m; y < tmpl.orig.Rect.Max.Y-m; y += 50 {
+		for x := m; x < tmpl.orig.Rect.Max.X-m; x += 50 {
+			ax, ay := a.Transform(float64(x), float64(y))
+			bx, by := b.Transform(float64(x), float64(y))
+			worst = fmax(worst, math.Hypot(ax-bx, ay-by))
+		}
+	}
+	return worst
+}
+
+// A scan stretched more across than down and keystoned, which the top line alone can't describe.
+func TestBorderTransform(t *testing.T) {
+	bj := synthBubbles()
+	orig := synthTemplate(&bj, 0)
+	truth := synthHomography{1.03, 0.004, 20, -0.006, 0.985, 15, 0, 2e-5, 1}
+	scan := synthScan(orig, truth, 60)
+	tmpl, err := NewTemplate(&bj, orig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tmpl.corners == nil {
+		t.Fatal("no border corners on template")
+	}
+	s := NewScanner(tmpl)
+	s.scanThresh = otsuThreshold(yHistogram(scan))
+
+	err = s.topLine(scan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	topErr := transformDistance(s.origToScanned, truth, tmpl)
+	err = s.borderTransform(scan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	borderErr := transformDistance(s.origToScanned, truth, tmpl)
+	t.Logf("initial transform off by up to %f px from the top line, %f px from the borders", topErr, borderErr)
+	if borderErr > 2 {
+		t.Errorf("border transform off by %f px", borderErr)
+	}
+	if topErr < 10 {
+		t.Errorf("top line only off by %f px, scan not distorted enough for this test", topErr)
+	}
+}
+
+// Images too small for the line finders to search have no border, they don't run off the edge.
+func TestBorderTinyImage(t *testing.T) {
+	bj := synthBubbles()
+	tmpl, err := NewTemplate(&bj, synthTemplate(&bj, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rect := range []image.Rectangle{image.Rect(0, 0, 400, 5), image.Rect(0, 0, 5, 400)} {
+		tiny := image.NewGray(rect)
+		synthFill(tiny, 0, 0, rect.Dx(), rect.Dy(), 255)
+		synthFill(tiny, 0, 0, rect.Dx(), 2, 0)
+		if _, err := findBorderCorners(tiny, 128); ErrorReason(err) != ReasonNoTopBorder {
+			t.Errorf("%v border corners: %v", rect, err)
+		}
+		s := NewScanner(tmpl)
+		s.scanThresh = 128
+		if err := s.topLine(tiny); ErrorReason(err) != ReasonNoTopBorder {
+			t.Errorf("%v top line: %v", rect, err)
+		}
+		if _, err := NewScanner(tmpl).ProcessScannedImage(tiny); ErrorReason(err) != ReasonNoTopBorder {
+			t.Errorf("%v scan: %v", rect, err)
+		}
+	}
+}
@@ -46,6 +46,8 @@ func fclamp(x, min, max float64) float64 {
 
 var dblimit = 10
 
+// ImageBiCatrom samples im at (x,y) with bicubic Catmull-Rom interpolation.
+// Near the edge the edge pixels are repeated outward; past the edge is black.
 func ImageBiCatrom(im image.Image, x, y float64) color.RGBA {
 	bound := im.Bounds()
 	fxf := math.Floor(x)
@@ -55,20 +57,15 @@ func ImageBiCatrom(im image.Image, x, y float64) color.RGBA {
 	if fx < bound.Min.X || fx >= bound.Max.X || fy < bound.Min.Y || fy >= bound.Max.Y {
 		return black
 	}
-	if fx < bound.Min.X+1 || fx >= bound.Max.X-1 || fy < bound.Min.Y+1 || fy >= bound.Max.Y-1 {
-		// linear interpolation at the edges.
-		// TODO!
-		return black
-	}
 	// first interpolate across each row to a point at x
 	var xw [4]float64
 	catromWeights(x-fxf, xw[:])
 	var xpoints [4]frgba
 	//var row [4]color.Color
 	for iy := 0; iy < 4; iy++ {
-		y := fy - 1 + iy
+		y := EdgeClamp.index(fy-1+iy, bound.Min.Y, bound.Max.Y)
 		for ix := 0; ix < 4; ix++ {
-			r, g, b, a := im.At(fx-1+ix, y).RGBA()
+			r, g, b, a := im.At(EdgeClamp.index(fx-1+ix, bound.Min.X, bound.Max.X), y).RGBA()
 			xpoints[iy].r += float64(r) * xw[ix]
 			xpoints[iy].g += float64(g) * xw[ix]
 			xpoints[iy].b += float64(b) * xw[ix]
@@ -98,6 +95,8 @@ func ImageBiCatrom(im image.Image, x, y float64) color.RGBA {
 	return color.RGBA{uint8(outf.r), uint8(outf.g), uint8(outf.b), uint8(outf.a)}
 }
 
+// YBiCatrom samples the luminance of im at (x,y) with bicubic Catmull-Rom interpolation.
+// Near the edge the edge pixels are repeated outward; past the edge is 0.
 func YBiCatrom(im *image.YCbCr, x, y float64) uint8 {
 	bound := im.Bounds()
 	fxf := math.Floor(x)
@@ -107,11 +106,6 @@ func YBiCatrom(im *image.YCbCr, x, y float64) uint8 {
 	if fx < bound.Min.X || fx >= bound.Max.X || fy < bound.Min.Y || fy >= bound.Max.Y {
 		return 0
 	}
-	if fx < bound.Min.X+1 || fx >= bound.Max.X-1 || fy < bound.Min.Y+1 || fy >= bound.Max.Y-1 {
-		// linear interpolation at the edges.
-		// TODO!
-		return 0
-	}
 	// first interpolate across each row to a point at x
 	var xw [4]float64
 	catromWeights(x-fxf, xw[:])
@@ -119,9 +113,9 @@ func YBiCatrom(im *image.YCbCr, x, y float64) uint8 {
 	var xyvals [4]float64
 	//var row [4]color.Color
 	for iy := 0; iy < 4; iy++ {
-		y := fy - 1 + iy
+		y := EdgeClamp.index(fy-1+iy, bound.Min.Y, bound.Max.Y)
 		for ix := 0; ix < 4; ix++ {
-			xyvals[iy] += float64(im.Y[(im.YStride*y)+(fx-1+ix)]) * xw[ix]
+			xyvals[iy] += float64(im.Y[im.YOffset(EdgeClamp.index(fx-1+ix, bound.Min.X, bound.Max.X), y)]) * xw[ix]
 		}
 	}
 
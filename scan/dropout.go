@@ -0,0 +1,103 @@
+package scan
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+)
+
+// DropoutSettings describes ink printed in a color meant to vanish from scans,
+// bubble outlines and instructions in red say, so that only voters' marks are measured.
+type DropoutSettings struct {
+	// Color is the ink, "#rrggbb"
+	Color string `json:"color"`
+
+	// Tolerance is how far in hue, in degrees, a pixel may be from Color and still drop out. 0 uses 30.
+	Tolerance float64 `json:"tolerance,omitempty"`
+}
+
+const defaultDropoutTolerance = 30.0
+
+// Pixels with less chroma than this, out of about 128, are grey and never drop out: black ink, pencil, paper.
+const minDropoutChroma = 12.0
+
+// dropout is DropoutSettings ready to apply
+type dropout struct {
+	// unit Cb,Cr direction of the ink's hue
+	cb, cr float64
+	// the ink's chroma, a pixel with this much or more is whitened all the way
+	chroma float64
+	// cosine of Tolerance
+	minCos float64
+}
+
+func newDropout(ds *DropoutSettings) (*dropout, error) {
+	var r, g, b uint8
+	_, err := fmt.Sscanf(ds.Color, "#%02x%02x%02x", &r, &g, &b)
+	if err != nil || len(ds.Color) != 7 {
+		return nil, newError(ReasonTemplateLoad, err, "dropout color %q is not #rrggbb", ds.Color)
+	}
+	_, cb, cr := color.RGBToYCbCr(r, g, b)
+	fcb := float64(cb) - 128
+	fcr := float64(cr) - 128
+	chroma := math.Hypot(fcb, fcr)
+	if chroma < minDropoutChroma {
+		return nil, newError(ReasonTemplateLoad, nil, "dropout color %s is grey, it would drop out the ballot", ds.Color)
+	}
+	tolerance := ds.Tolerance
+	if tolerance <= 0 {
+		tolerance = defaultDropoutTolerance
+	}
+	return &dropout{
+		cb:     fcb / chroma,
+		cr:     fcr / chroma,
+		chroma: chroma,
+		minCos: math.Cos(tolerance * math.Pi / 180),
+	}, nil
+}
+
+// whiten lightens a luminance value by how much its chroma looks like the dropout ink.
+// A pixel that is all ink becomes white, a blend of ink and paper or of ink and a voter's mark only partly.
+func (d *dropout) whiten(y, cb, cr uint8) uint8 {
+	fcb := float64(cb) - 128
+	fcr := float64(cr) - 128
+	chroma := math.Hypot(fcb, fcr)
+	if chroma < minDropoutChroma {
+		return y
+	}
+	if ((fcb*d.cb)+(fcr*d.cr))/chroma < d.minCos {
+		return y
+	}
+	strength := math.Min(1, chroma/d.chroma)
+	return uint8(float64(y) + ((255 - float64(y)) * strength) + 0.5)
+}
+
+// apply whitens the dropout ink in lp, the luminance plane made from im by lumaPlane
+func (d *dropout) apply(im image.Image, lp *image.Gray) {
+	bounds := im.Bounds()
+	width := bounds.Dx()
+	height := bounds.Dy()
+	switch it := im.(type) {
+	case *image.YCbCr:
+		for y := 0; y < height; y++ {
+			oi := y * lp.Stride
+			for x := 0; x < width; x++ {
+				ci := it.COffset(bounds.Min.X+x, bounds.Min.Y+y)
+				lp.Pix[oi+x] = d.whiten(lp.Pix[oi+x], it.Cb[ci], it.Cr[ci])
+			}
+		}
+	case *image.Gray, *image.Gray16:
+		// no color to drop
+	default:
+		for y := 0; y < height; y++ {
+			oi := y * lp.Stride
+			for x := 0; x < width; x++ {
+				r, g, b, a := im.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+				// composite over white, as premulY
+				_, cb, cr := color.RGBToYCbCr(uint8((r+0xffff-a)>>8), uint8((g+0xffff-a)>>8), uint8((b+0xffff-a)>>8))
+				lp.Pix[oi+x] = d.whiten(lp.Pix[oi+x], cb, cr)
+			}
+		}
+	}
+}
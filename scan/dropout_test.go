@@ -0,0 +1,58 @@
+package scan
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestDropout(t *testing.T) {
+	d, err := newDropout(&DropoutSettings{Color: "#dc1e1e"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pixels := []struct {
+		name string
+		c    color.NRGBA
+		// whether it should come out light or dark
+		light bool
+	}{
+		{"paper", color.NRGBA{255, 255, 255, 255}, true},
+		{"red ink", color.NRGBA{220, 30, 30, 255}, true},
+		{"ink edge", color.NRGBA{240, 150, 150, 255}, true},
+		{"orange-red ink", color.NRGBA{230, 70, 20, 255}, true},
+		{"black ink", color.NRGBA{0, 0, 0, 255}, false},
+		{"pencil", color.NRGBA{90, 90, 90, 255}, false},
+		{"blue pen", color.NRGBA{30, 30, 200, 255}, false},
+		{"pencil over red ink", color.NRGBA{60, 10, 10, 255}, false},
+	}
+	rect := image.Rect(0, 0, len(pixels), 1)
+	nrgba := image.NewNRGBA(rect)
+	ycc := image.NewYCbCr(rect, image.YCbCrSubsampleRatio444)
+	for x, p := range pixels {
+		nrgba.Set(x, 0, p.c)
+		yy, cb, cr := color.RGBToYCbCr(p.c.R, p.c.G, p.c.B)
+		ycc.Y[ycc.YOffset(x, 0)] = yy
+		ycc.Cb[ycc.COffset(x, 0)] = cb
+		ycc.Cr[ycc.COffset(x, 0)] = cr
+	}
+	for _, im := range []image.Image{nrgba, ycc} {
+		lp := lumaPlane(im)
+		d.apply(im, lp)
+		for x, p := range pixels {
+			v := lp.Pix[x]
+			// a blend of ink and paper is only partly whitened, but comes out well above any threshold
+			if p.light && v < 200 {
+				t.Errorf("%T %s = %d, should drop out", im, p.name, v)
+			} else if !p.light && v >= 128 {
+				t.Errorf("%T %s = %d, should stay dark", im, p.name, v)
+			}
+		}
+	}
+
+	for _, bad := range []string{"red", "#12345", "#808080"} {
+		if _, err := newDropout(&DropoutSettings{Color: bad}); ErrorReason(err) != ReasonTemplateLoad {
+			t.Errorf("dropout color %q: %v", bad, err)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package scan
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Reason is a machine readable code for why a scan failed.
+type Reason string
+
+const (
+	// the template image or bubbles json could not be read or doesn't make sense
+	ReasonTemplateLoad Reason = "template_load"
+
+	// the scanned image could not be decoded or is empty
+	ReasonUnsupportedImage Reason = "unsupported_image"
+
+	// the scanned image file could not be opened
+	ReasonImageRead Reason = "image_read"
+
+	// no page border was found in the scan in any orientation
+	ReasonNoTopBorder Reason = "no_top_border"
+
+	// too few of the template's fiducials were found on the scan in any orientation
+	ReasonNoFiducials Reason = "no_fiducials"
+
+	// fitting the template to the scan produced a degenerate transform
+	ReasonAlignmentDiverged Reason = "alignment_diverged"
+
+	// the template fit the scan too poorly to trust, see AlignmentLimits
+	ReasonMisaligned Reason = "misaligned"
+
+	// a debug image could not be written
+	ReasonDebugOutput Reason = "debug_output"
+)
+
+// Error is the error returned from Scanner for a failure the caller can act on.
+type Error struct {
+	Reason Reason
+	Msg    string
+
+	// Err is the underlying error, may be nil
+	Err error
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s: %s: %v", e.Reason, e.Msg, e.Err)
+	}
+	return fmt.Sprintf("%s: %s", e.Reason, e.Msg)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func newError(reason Reason, err error, format string, args ...interface{}) *Error {
+	return &Error{Reason: reason, Msg: fmt.Sprintf(format, args...), Err: err}
+}
+
+// ErrorReason returns the Reason of a scan Error anywhere in err's chain, or "" if there isn't one.
+func ErrorReason(err error) Reason {
+	var se *Error
+	if errors.As(err, &se) {
+		return se.Reason
+	}
+	return ""
+}
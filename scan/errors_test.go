@@ -0,0 +1,13 @@
+package scan
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestReadScannedImageMissing(t *testing.T) {
+	_, err := NewScanner(nil).ReadScannedImage(filepath.Join("no", "such", "dir", "scan.png"))
+	if ErrorReason(err) != ReasonImageRead {
+		t.Errorf("got %v, want %s", err, ReasonImageRead)
+	}
+}
@@ -0,0 +1,281 @@
+package scan
+
+import (
+	"image"
+	"math"
+)
+
+// Registration strategies for DrawSettings.Registration
+const (
+	// RegistrationBorder finds the page border for a first estimate, then matches patches of the template's own texture.
+	RegistrationBorder = "border"
+
+	// RegistrationFiducial fits the transform to the centroids of the solid marks listed in DrawSettings.Fiducials,
+	// corner squares or a timing track down the margin. Marks that look the same with the page upside down
+	// can't tell which way up it is, so a layout should make at least one mark different from its opposite.
+	RegistrationFiducial = "fiducial"
+)
+
+// fiducial is a solid mark printed on the template for registration
+type fiducial struct {
+	// darkness weighted centroid in template pixels
+	center FPoint
+
+	// dark pixel count
+	area float64
+}
+
+// blob is a 4-connected region of dark pixels
+type blob struct {
+	area int
+	// bounding box
+	rect image.Rectangle
+}
+
+// darkBlobs finds the connected regions of pixels darker than threshold inside r
+func darkBlobs(it *image.Gray, r image.Rectangle, threshold uint8) []blob {
+	r = r.Intersect(it.Rect)
+	width := r.Dx()
+	seen := make([]bool, width*r.Dy())
+	var out []blob
+	var stack []image.Point
+	dark := func(x, y int) bool {
+		return it.Pix[((y-it.Rect.Min.Y)*it.Stride)+(x-it.Rect.Min.X)] < threshold
+	}
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			si := ((y - r.Min.Y) * width) + (x - r.Min.X)
+			if seen[si] || !dark(x, y) {
+				continue
+			}
+			seen[si] = true
+			b := blob{rect: image.Rect(x, y, x+1, y+1)}
+			stack = append(stack[:0], image.Point{x, y})
+			for len(stack) > 0 {
+				p := stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+				b.area++
+				b.rect = b.rect.Union(image.Rect(p.X, p.Y, p.X+1, p.Y+1))
+				for _, n := range [4]image.Point{{p.X - 1, p.Y}, {p.X + 1, p.Y}, {p.X, p.Y - 1}, {p.X, p.Y + 1}} {
+					if !n.In(r) {
+						continue
+					}
+					ni := ((n.Y - r.Min.Y) * width) + (n.X - r.Min.X)
+					if !seen[ni] && dark(n.X, n.Y) {
+						seen[ni] = true
+						stack = append(stack, n)
+					}
+				}
+			}
+			out = append(out, b)
+		}
+	}
+	return out
+}
+
+// markCentroid is the centroid of the mark in box, each pixel weighted by how much darker it is than the paper just outside box.
+func markCentroid(it *image.Gray, box image.Rectangle) FPoint {
+	outer := box.Inset(-2).Intersect(it.Rect)
+	pix := func(x, y int) float64 {
+		return float64(it.Pix[((y-it.Rect.Min.Y)*it.Stride)+(x-it.Rect.Min.X)])
+	}
+	paper := 0.0
+	count := 0
+	for y := outer.Min.Y; y < outer.Max.Y; y++ {
+		for x := outer.Min.X; x < outer.Max.X; x++ {
+			if y == outer.Min.Y || y == outer.Max.Y-1 || x == outer.Min.X || x == outer.Max.X-1 {
+				paper += pix(x, y)
+				count++
+			}
+		}
+	}
+	paper /= float64(count)
+	var sx, sy, sw float64
+	for y := outer.Min.Y; y < outer.Max.Y; y++ {
+		for x := outer.Min.X; x < outer.Max.X; x++ {
+			w := paper - pix(x, y)
+			if w > 0 {
+				sx += w * float64(x)
+				sy += w * float64(y)
+				sw += w
+			}
+		}
+	}
+	if sw == 0 {
+		c := box.Min.Add(box.Max)
+		return FPoint{X: (float64(c.X) - 1) / 2, Y: (float64(c.Y) - 1) / 2}
+	}
+	return FPoint{X: sx / sw, Y: sy / sw}
+}
+
+// largestBlob is the index of the blob with the most pixels, -1 if there are none
+func largestBlob(blobs []blob) int {
+	best := -1
+	for i, b := range blobs {
+		if best < 0 || b.area > blobs[best].area {
+			best = i
+		}
+	}
+	return best
+}
+
+// findFiducials locates each of DrawSettings.Fiducials on the template image
+func (t *Template) findFiducials() error {
+	ds := t.bj.DrawSettings
+	if len(ds.Fiducials) < 3 {
+		return newError(ReasonTemplateLoad, nil, "fiducial registration needs at least 3 fiducials, have %d", len(ds.Fiducials))
+	}
+	for i, xywh := range ds.Fiducials {
+		if len(xywh) < 4 {
+			return newError(ReasonTemplateLoad, nil, "fiducial %d rect %v is not [x,y, width,height]", i, xywh)
+		}
+		r := t.pxRect(xywh)
+		// look a little past the rect in case the mark was drawn slightly off
+		grow := (math.Max(r.w, r.h) / 4) + 2
+		box := image.Rect(int(r.x-grow), int(r.y-grow), int(math.Ceil(r.x+r.w+grow)), int(math.Ceil(r.y+r.h+grow)))
+		blobs := darkBlobs(t.orig, box, t.thresh)
+		bi := largestBlob(blobs)
+		if bi < 0 || float64(blobs[bi].area) < 0.25*r.w*r.h {
+			return newError(ReasonTemplateLoad, nil, "fiducial %d not printed on template at %v", i, box)
+		}
+		t.fiducials = append(t.fiducials, fiducial{
+			center: markCentroid(t.orig, blobs[bi].rect),
+			area:   float64(blobs[bi].area),
+		})
+	}
+	return nil
+}
+
+// cornerIndexes are the points furthest toward the top left, top right, bottom right and bottom left
+func cornerIndexes(points []FPoint) [4]int {
+	var out [4]int
+	var best [4]float64
+	for i, p := range points {
+		scores := [4]float64{-(p.X + p.Y), p.X - p.Y, p.X + p.Y, p.Y - p.X}
+		for c, score := range scores {
+			if i == 0 || score > best[c] {
+				best[c] = score
+				out[c] = i
+			}
+		}
+	}
+	return out
+}
+
+// a scan mark this much smaller or bigger than the template's fiducials, scaled, isn't one
+const minFiducialAreaRatio = 0.4
+const maxFiducialAreaRatio = 2.5
+
+// a fiducial mark fills at least this much of its bounding box, a rotated square about half
+const minFiducialSolidity = 0.5
+
+// fiducialTransform fits origToScanned to the template's fiducials found on the scan, and sets s.alignment from them.
+// The scan's outermost fiducial-like marks give a first fit, which then pairs every fiducial with the nearest mark.
+func (s *Scanner) fiducialTransform(it *image.Gray) error {
+	fids := s.t.fiducials
+	orect := s.t.orig.Rect
+	// scan pixels per template pixel, taking the scan to be mostly page
+	scale := math.Sqrt(float64(it.Rect.Dx()*it.Rect.Dy()) / float64(orect.Dx()*orect.Dy()))
+	minArea := fids[0].area
+	maxArea := fids[0].area
+	for _, f := range fids {
+		minArea = math.Min(minArea, f.area)
+		maxArea = math.Max(maxArea, f.area)
+	}
+	minArea *= minFiducialAreaRatio * scale * scale
+	maxArea *= maxFiducialAreaRatio * scale * scale
+	var marks []blob
+	var markCenters []FPoint
+	for _, b := range darkBlobs(it, it.Rect, s.scanThresh) {
+		area := float64(b.area)
+		if area < minArea || area > maxArea || area < minFiducialSolidity*float64(b.rect.Dx()*b.rect.Dy()) {
+			continue
+		}
+		marks = append(marks, b)
+		markCenters = append(markCenters, markCentroid(it, b.rect))
+	}
+	s.debug("%d fiducial-like marks\n", len(marks))
+	if len(marks) < 3 {
+		return newError(ReasonNoFiducials, nil, "%d fiducial-like marks on scan", len(marks))
+	}
+
+	fidCenters := make([]FPoint, len(fids))
+	minSpacing := math.Inf(1)
+	for i, f := range fids {
+		fidCenters[i] = f.center
+		for _, g := range fids[:i] {
+			minSpacing = math.Min(minSpacing, math.Hypot(f.center.X-g.center.X, f.center.Y-g.center.Y))
+		}
+	}
+	var sources, dests [4]FPoint
+	fidCorners := cornerIndexes(fidCenters)
+	markCorners := cornerIndexes(markCenters)
+	for c := range sources {
+		sources[c] = fidCenters[fidCorners[c]]
+		dests[c] = markCenters[markCorners[c]]
+	}
+	first := FindTransform(sources[:], dests[:])
+	if !finiteMatrix(first) {
+		return newError(ReasonNoFiducials, nil, "outer marks %v don't fit outer fiducials %v", dests, sources)
+	}
+	firstTransform := MatrixTransform{first}
+
+	// pair each fiducial with the nearest mark to where the first fit puts it
+	radius := minSpacing * scale / 2
+	matched := make([]int, len(fids))
+	var msources, mdests []FPoint
+	for i, fc := range fidCenters {
+		px, py := firstTransform.Transform(fc.X, fc.Y)
+		matched[i] = -1
+		bestd := radius
+		for mi, mc := range markCenters {
+			d := math.Hypot(mc.X-px, mc.Y-py)
+			if d < bestd {
+				bestd = d
+				matched[i] = mi
+			}
+		}
+		if matched[i] >= 0 {
+			msources = append(msources, fc)
+			mdests = append(mdests, markCenters[matched[i]])
+		}
+	}
+	if len(msources) < 3 {
+		return newError(ReasonNoFiducials, nil, "only %d of %d fiducials found on scan", len(msources), len(fids))
+	}
+	fmat, inliers := FindTransformRansac(msources, mdests, s.AlignmentLimits.orDefault().MaxInlierResidual)
+	s.debug("transform %v\n", fmat)
+	if !finiteMatrix(fmat) {
+		return newError(ReasonAlignmentDiverged, nil, "fiducial fit gave transform %v", fmat)
+	}
+	fit := &MatrixTransform{fmat}
+
+	// a fiducial's match error is how far its scanned area is from the template's, scaled by the fit
+	areaScale := math.Abs((fmat[0] * fmat[4]) - (fmat[1] * fmat[3]))
+	s.alignment = AlignmentQuality{Hotspots: make([]HotspotMatch, len(fids))}
+	mi := 0
+	for i, f := range fids {
+		hm := &s.alignment.Hotspots[i]
+		hm.X = f.center.X
+		hm.Y = f.center.Y
+		if matched[i] < 0 {
+			// missing
+			hm.ScanX, hm.ScanY = fit.Transform(f.center.X, f.center.Y)
+			hm.MatchError = 1
+			hm.Outlier = true
+		} else {
+			hm.ScanX = markCenters[matched[i]].X
+			hm.ScanY = markCenters[matched[i]].Y
+			hm.MatchError = math.Min(1, math.Abs((float64(marks[matched[i]].area)/(f.area*areaScale))-1))
+			hm.Outlier = !inliers[mi]
+			mi++
+		}
+		s.alignment.MeanMatchError += hm.MatchError
+		s.alignment.WorstMatchError = fmax(s.alignment.WorstMatchError, hm.MatchError)
+	}
+	s.alignment.MeanMatchError /= float64(len(fids))
+	s.origToScanned = fit
+	s.alignment.measureFit(s.origToScanned, float64(orect.Max.X)/2, float64(orect.Max.Y)/2)
+	s.debug("%d/%d fiducials inliers, reprojection rms %f max %f, scale (%f,%f) skew %f\n", s.alignment.Inliers, len(fids), s.alignment.ReprojectionRMS, s.alignment.ReprojectionMax, s.alignment.ScaleX, s.alignment.ScaleY, s.alignment.Skew)
+	return nil
+}
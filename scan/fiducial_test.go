@@ -0,0 +1,88 @@
+package scan
+
+import (
+	"image"
+	"reflect"
+	"testing"
+)
+
+// synthFiducialBubbles is the synthetic ballot registered by corner squares and a timing track down the left margin
+func synthFiducialBubbles() BubblesJson {
+	bj := synthBubbles()
+	ds := *bj.DrawSettings
+	ds.Registration = RegistrationFiducial
+	ds.Fiducials = [][]float64{{12, 12, 12, 12}, {588, 12, 12, 12}, {588, 768, 12, 12}, {12, 768, 12, 12}}
+	for y := 100.0; y < 700; y += 50 {
+		ds.Fiducials = append(ds.Fiducials, []float64{14, y, 8, 5})
+	}
+	bj.DrawSettings = &ds
+	return bj
+}
+
+// synthFiducialTemplate is synthTemplate with the fiducials in place of the border
+func synthFiducialTemplate(bj *BubblesJson, style int) *image.Gray {
+	orig := synthTemplate(bj, style)
+	w := orig.Rect.Max.X
+	h := orig.Rect.Max.Y
+	m := int(bj.DrawSettings.PageMargin * synthPxPerPt)
+	synthFill(orig, m, m, w-m, m+8, 255)
+	synthFill(orig, m, h-m-8, w-m, h-m, 255)
+	synthFill(orig, m, m, m+8, h-m, 255)
+	synthFill(orig, w-m-8, m, w-m, h-m, 255)
+	for _, xywh := range bj.DrawSettings.Fiducials {
+		x0 := int(xywh[0] * synthPxPerPt)
+		y0 := h - int((xywh[1]+xywh[3])*synthPxPerPt)
+		synthFill(orig, x0, y0, x0+int(xywh[2]*synthPxPerPt), y0+int(xywh[3]*synthPxPerPt), 0)
+	}
+	return orig
+}
+
+func TestFiducialRegistration(t *testing.T) {
+	bj := synthFiducialBubbles()
+	orig := synthFiducialTemplate(&bj, 0)
+	synthBubble(orig, bj.Bubbles[0]["mayor"]["carol"], true)
+	truth := synthAffine{1.01, -0.006, 0.006, 1.01, 17.3, 11.8}
+	scan := synthScan(orig, truth, 50)
+	tmpl, err := NewTemplate(&bj, synthFiducialTemplate(&bj, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tmpl.hotspots != nil || len(tmpl.fiducials) != len(bj.DrawSettings.Fiducials) {
+		t.Fatalf("%d hotspots, %d of %d fiducials", len(tmpl.hotspots), len(tmpl.fiducials), len(bj.DrawSettings.Fiducials))
+	}
+	want := map[string]map[string]bool{
+		"mayor":   {"carol": true},
+		"council": {},
+	}
+
+	// the timing track is only down one side, so upside down can't be mistaken for upright
+	for _, turns := range []int{0, 2} {
+		s := NewScanner(tmpl)
+		result, err := s.ProcessScannedImage(rotateGray(scan, turns))
+		if err != nil {
+			t.Fatalf("turned %d: %v", turns*90, err)
+		}
+		if got := result.Marked(); !reflect.DeepEqual(got, want) {
+			t.Errorf("turned %d: got %v, want %v", turns*90, got, want)
+		}
+		if result.Orientation != ((4-turns)%4)*90 {
+			t.Errorf("turned %d: orientation %d", turns*90, result.Orientation)
+		}
+		if turns == 0 {
+			if s.alignment.Inliers != len(tmpl.fiducials) {
+				t.Errorf("%d of %d fiducials inliers", s.alignment.Inliers, len(tmpl.fiducials))
+			}
+			if e := synthHotspotError(&s.alignment, truth); e > 0.25 {
+				t.Errorf("median fiducial error %f px", e)
+			}
+		}
+	}
+}
+
+func TestFiducialMissingFromTemplate(t *testing.T) {
+	bj := synthFiducialBubbles()
+	_, err := NewTemplate(&bj, synthTemplate(&bj, 0))
+	if ErrorReason(err) != ReasonTemplateLoad {
+		t.Errorf("template without fiducials printed: %v", err)
+	}
+}
@@ -0,0 +1,181 @@
+package scan
+
+import "math"
+
+// about how many hotspots to find, one per grid cell
+const nHotspots = 20
+
+// hotspot centers are considered every hotspotStride pixels
+const hotspotStride = 3
+
+// the best corners in each grid cell are checked in order until one is distinctive
+const hotspotCandidates = 5
+
+// A patch that differs from itself shifted by a few pixels in fewer than this fraction of its pixels
+// could match the scan in the wrong place, like a patch of evenly spaced lines.
+const minHotspotDistinct = 0.08
+
+// shifts smaller than this are the same feature, not a look-alike
+const minLookAlikeShift = 3
+
+// cornerMap is the cornerScore of every hotspotStride'th pixel where a hotspot could be centered,
+// scored once and shared by each grid of hotspots picked from it.
+type cornerMap struct {
+	// first scored pixel, and the scored area
+	minx, miny    int
+	width, height int
+	// scores per row of scored pixels
+	stride int
+	score  []float64
+}
+
+func (t *Template) newCornerMap() *cornerMap {
+	orect := t.orig.Rect
+	// keep patches inside the image
+	cm := &cornerMap{
+		minx:   orect.Min.X + hotspotSize,
+		miny:   orect.Min.Y + hotspotSize,
+		width:  orect.Dx() - (2 * hotspotSize),
+		height: orect.Dy() - (2 * hotspotSize),
+	}
+	cm.stride = (cm.width + hotspotStride - 1) / hotspotStride
+	rows := (cm.height + hotspotStride - 1) / hotspotStride
+	cm.score = make([]float64, cm.stride*rows)
+	for row := 0; row < rows; row++ {
+		for col := 0; col < cm.stride; col++ {
+			cm.score[(row*cm.stride)+col] = t.cornerScore(cm.minx+(col*hotspotStride), cm.miny+(row*hotspotStride))
+		}
+	}
+	return cm
+}
+
+// at is the score at (x,y), which must be a scored pixel
+func (cm *cornerMap) at(x, y int) float64 {
+	return cm.score[(((y-cm.miny)/hotspotStride)*cm.stride)+((x-cm.minx)/hotspotStride)]
+}
+
+// first scored coordinate at or after v along an axis scored from start
+func scoredFrom(v, start int) int {
+	return start + (((v - start + hotspotStride - 1) / hotspotStride) * hotspotStride)
+}
+
+// findHotspots picks about n hotspot centers for a template.
+// The page is divided into a grid of about n cells so the hotspots cover the whole page,
+// and each cell contributes its strongest corner whose patch doesn't look like its surroundings.
+// There is nothing random about it; a template always gets the same hotspots.
+func (t *Template) findHotspots(n int, cm *cornerMap) []point {
+	minx := cm.minx
+	miny := cm.miny
+	width := cm.width
+	height := cm.height
+	cols := int(math.Round(math.Sqrt(float64(n) * float64(width) / float64(height))))
+	if cols < 1 {
+		cols = 1
+	}
+	rows := (n + cols - 1) / cols
+
+	spots := make([]point, 0, cols*rows)
+	var candidates [hotspotCandidates]point
+	var scores [hotspotCandidates]float64
+	for row := 0; row < rows; row++ {
+		y0 := miny + ((row * height) / rows)
+		y1 := miny + (((row + 1) * height) / rows)
+		for col := 0; col < cols; col++ {
+			x0 := minx + ((col * width) / cols)
+			x1 := minx + (((col + 1) * width) / cols)
+			count := 0
+			for y := scoredFrom(y0, miny); y < y1; y += hotspotStride {
+				for x := scoredFrom(x0, minx); x < x1; x += hotspotStride {
+					score := cm.at(x, y)
+					if score <= 0 {
+						continue
+					}
+					// insertion sort, keeping the first found of equal scores
+					pos := count
+					for pos > 0 && score > scores[pos-1] {
+						if pos < hotspotCandidates {
+							candidates[pos] = candidates[pos-1]
+							scores[pos] = scores[pos-1]
+						}
+						pos--
+					}
+					if pos < hotspotCandidates {
+						candidates[pos] = point{x, y}
+						scores[pos] = score
+						if count < hotspotCandidates {
+							count++
+						}
+					}
+				}
+			}
+			for _, c := range candidates[:count] {
+				if t.hotspotDistinct(c) >= minHotspotDistinct {
+					spots = append(spots, c)
+					break
+				}
+			}
+		}
+	}
+	return spots
+}
+
+// cornerScore is the Shi-Tomasi corner strength of the hotspot patch centered at (cx,cy):
+// the smaller eigenvalue of the gradient structure tensor, high only where there are edges in both directions.
+func (t *Template) cornerScore(cx, cy int) float64 {
+	var sxx, syy, sxy float64
+	pix := t.orig.Pix
+	stride := t.orig.Stride
+	for y := cy - (hotspotSize / 2); y <= cy+(hotspotSize/2); y++ {
+		row := y * stride
+		for x := cx - (hotspotSize / 2); x <= cx+(hotspotSize/2); x++ {
+			pi := row + x
+			gx := float64(pix[pi+1]) - float64(pix[pi-1])
+			gy := float64(pix[pi+stride]) - float64(pix[pi-stride])
+			sxx += gx * gx
+			syy += gy * gy
+			sxy += gx * gy
+		}
+	}
+	half := (sxx + syy) / 2
+	d := (sxx - syy) / 2
+	return (half - math.Sqrt((d*d)+(sxy*sxy))) / (hotspotSize * hotspotSize)
+}
+
+// hotspotDistinct is the smallest fraction of thresholded pixels that differ between the patch at c
+// and the patch shifted anywhere in the search window by at least minLookAlikeShift.
+func (t *Template) hotspotDistinct(c point) float64 {
+	mx := c.x - (hotspotSize / 2)
+	my := c.y - (hotspotSize / 2)
+	light := func(x, y int) bool {
+		if x < t.orig.Rect.Min.X || y < t.orig.Rect.Min.Y || x >= t.orig.Rect.Max.X || y >= t.orig.Rect.Max.Y {
+			return true
+		}
+		return t.orig.Pix[(y*t.orig.Stride)+x] >= t.thresh
+	}
+	var patch [hotspotSize * hotspotSize]bool
+	for iy := 0; iy < hotspotSize; iy++ {
+		for ix := 0; ix < hotspotSize; ix++ {
+			patch[(hotspotSize*iy)+ix] = light(mx+ix, my+iy)
+		}
+	}
+	best := hotspotSize * hotspotSize
+	for dy := -seekSize / 2; dy <= seekSize/2; dy++ {
+		for dx := -seekSize / 2; dx <= seekSize/2; dx++ {
+			if dx > -minLookAlikeShift && dx < minLookAlikeShift && dy > -minLookAlikeShift && dy < minLookAlikeShift {
+				continue
+			}
+			diff := 0
+			for iy := 0; iy < hotspotSize && diff < best; iy++ {
+				for ix := 0; ix < hotspotSize; ix++ {
+					if patch[(hotspotSize*iy)+ix] != light(mx+dx+ix, my+dy+iy) {
+						diff++
+					}
+				}
+			}
+			if diff < best {
+				best = diff
+			}
+		}
+	}
+	return float64(best) / (hotspotSize * hotspotSize)
+}
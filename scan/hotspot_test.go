@@ -0,0 +1,59 @@
+package scan
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestHotspotsReproducible(t *testing.T) {
+	bj := synthBubbles()
+	orig := synthTemplate(&bj, 0)
+	synthBubble(orig, bj.Bubbles[0]["council"]["yolanda"], true)
+	scan := synthScan(orig, synthRotation(-0.005, 17.3, 22.8), 40)
+
+	var spots [2][]point
+	var results [2]*ScanResult
+	for i := range results {
+		tmpl, err := NewTemplate(&bj, synthTemplate(&bj, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, hs := range tmpl.hotspots {
+			spots[i] = append(spots[i], hs.center)
+		}
+		results[i], err = NewScanner(tmpl).ProcessScannedImage(scan)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !reflect.DeepEqual(spots[0], spots[1]) {
+		t.Errorf("hotspots differ: %v, %v", spots[0], spots[1])
+	}
+	if !reflect.DeepEqual(results[0], results[1]) {
+		t.Errorf("scan results differ: %v, %v", results[0].Transform, results[1].Transform)
+	}
+
+	// spread over the page, not clustered
+	if len(spots[0]) < nHotspots/2 {
+		t.Fatalf("only %d hotspots", len(spots[0]))
+	}
+	minx, miny := orig.Rect.Max.X, orig.Rect.Max.Y
+	maxx, maxy := 0, 0
+	for _, p := range spots[0] {
+		if p.x < minx {
+			minx = p.x
+		}
+		if p.y < miny {
+			miny = p.y
+		}
+		if p.x > maxx {
+			maxx = p.x
+		}
+		if p.y > maxy {
+			maxy = p.y
+		}
+	}
+	if maxx-minx < orig.Rect.Dx()/2 || maxy-miny < orig.Rect.Dy()/2 {
+		t.Errorf("hotspots only cover (%d,%d)-(%d,%d) of %v", minx, miny, maxx, maxy, orig.Rect)
+	}
+}
@@ -0,0 +1,168 @@
+package scan
+
+import (
+	"image"
+	"math"
+)
+
+// Interpolator samples a luminance plane between pixel centers, which are at whole coordinates.
+// Samples near or past the edge of the image use pixels from inside it, by the interpolator's EdgeMode.
+type Interpolator interface {
+	Sample(im *image.Gray, x, y float64) uint8
+}
+
+// EdgeMode is what an Interpolator reads for pixels outside the image.
+type EdgeMode int
+
+const (
+	// EdgeClamp repeats the nearest edge pixel
+	EdgeClamp EdgeMode = iota
+
+	// EdgeReflect mirrors the image about its outer edge, so the pixel one outside is the edge pixel itself
+	EdgeReflect
+)
+
+// index maps a pixel coordinate to one inside [min,max)
+func (e EdgeMode) index(i, min, max int) int {
+	if i >= min && i < max {
+		return i
+	}
+	if e == EdgeReflect {
+		n := max - min
+		k := (i - min) % (2 * n)
+		if k < 0 {
+			k += 2 * n
+		}
+		if k >= n {
+			k = (2 * n) - 1 - k
+		}
+		return min + k
+	}
+	if i < min {
+		return min
+	}
+	return max - 1
+}
+
+// DefaultInterpolator is used when a Scanner has no Interpolator set.
+var DefaultInterpolator Interpolator = CatmullRomInterpolator{Edge: EdgeClamp}
+
+// NearestInterpolator takes the nearest pixel.
+type NearestInterpolator struct {
+	Edge EdgeMode
+}
+
+func (ni NearestInterpolator) Sample(im *image.Gray, x, y float64) uint8 {
+	px := ni.Edge.index(int(math.Floor(x+0.5)), im.Rect.Min.X, im.Rect.Max.X)
+	py := ni.Edge.index(int(math.Floor(y+0.5)), im.Rect.Min.Y, im.Rect.Max.Y)
+	return im.Pix[im.PixOffset(px, py)]
+}
+
+// BilinearInterpolator blends the four surrounding pixels.
+type BilinearInterpolator struct {
+	Edge EdgeMode
+}
+
+func (bi BilinearInterpolator) Sample(im *image.Gray, x, y float64) uint8 {
+	var xw, yw [2]float64
+	fxf := math.Floor(x)
+	fyf := math.Floor(y)
+	xw[1] = x - fxf
+	xw[0] = 1 - xw[1]
+	yw[1] = y - fyf
+	yw[0] = 1 - yw[1]
+	return separableSample(im, bi.Edge, int(fxf), int(fyf), xw[:], yw[:])
+}
+
+// CatmullRomInterpolator is bicubic over the surrounding 4x4 pixels, sharper than bilinear.
+type CatmullRomInterpolator struct {
+	Edge EdgeMode
+}
+
+func (ci CatmullRomInterpolator) Sample(im *image.Gray, x, y float64) uint8 {
+	var xw, yw [4]float64
+	fxf := math.Floor(x)
+	fyf := math.Floor(y)
+	catromWeights(x-fxf, xw[:])
+	catromWeights(y-fyf, yw[:])
+	return separableSample(im, ci.Edge, int(fxf), int(fyf), xw[:], yw[:])
+}
+
+// LanczosInterpolator is a windowed sinc over the surrounding 2*Lobes pixels each way,
+// the sharpest here and the slowest. Lobes 0 is 3.
+type LanczosInterpolator struct {
+	Edge  EdgeMode
+	Lobes int
+}
+
+// most Lanczos lobes supported
+const maxLanczosLobes = 8
+
+func (li LanczosInterpolator) Sample(im *image.Gray, x, y float64) uint8 {
+	lobes := li.Lobes
+	if lobes <= 0 {
+		lobes = 3
+	} else if lobes > maxLanczosLobes {
+		lobes = maxLanczosLobes
+	}
+	var xw, yw [2 * maxLanczosLobes]float64
+	fxf := math.Floor(x)
+	fyf := math.Floor(y)
+	lanczosWeights(x-fxf, lobes, xw[:2*lobes])
+	lanczosWeights(y-fyf, lobes, yw[:2*lobes])
+	return separableSample(im, li.Edge, int(fxf), int(fyf), xw[:2*lobes], yw[:2*lobes])
+}
+
+// lanczosWeights fills weights for the pixels at 1-lobes..lobes from the one before x, 0 <= x < 1
+func lanczosWeights(x float64, lobes int, weights []float64) {
+	sum := 0.0
+	for i := range weights {
+		t := float64(i+1-lobes) - x
+		w := 1.0
+		if t != 0 {
+			pt := math.Pi * t
+			w = float64(lobes) * math.Sin(pt) * math.Sin(pt/float64(lobes)) / (pt * pt)
+		}
+		weights[i] = w
+		sum += w
+	}
+	for i := range weights {
+		weights[i] /= sum
+	}
+}
+
+// separableSample weights len(xw) by len(yw) pixels around (fx,fy), fx,fy being the pixel before the sample point,
+// first across each row and then down the column of row values.
+func separableSample(im *image.Gray, edge EdgeMode, fx, fy int, xw, yw []float64) uint8 {
+	x0 := fx + 1 - (len(xw) / 2)
+	y0 := fy + 1 - (len(yw) / 2)
+	inside := x0 >= im.Rect.Min.X && x0+len(xw) <= im.Rect.Max.X && y0 >= im.Rect.Min.Y && y0+len(yw) <= im.Rect.Max.Y
+	out := 0.0
+	for iy, wy := range yw {
+		py := y0 + iy
+		row := 0.0
+		if inside {
+			pi := im.PixOffset(x0, py)
+			for ix, wx := range xw {
+				row += float64(im.Pix[pi+ix]) * wx
+			}
+		} else {
+			py = edge.index(py, im.Rect.Min.Y, im.Rect.Max.Y)
+			for ix, wx := range xw {
+				px := edge.index(x0+ix, im.Rect.Min.X, im.Rect.Max.X)
+				row += float64(im.Pix[im.PixOffset(px, py)]) * wx
+			}
+		}
+		out += row * wy
+	}
+	// round, a blank page sums to 254.999...
+	return uint8(fclamp(out, 0, 255) + 0.5)
+}
+
+// sample is the scan luminance at (x,y) by the Scanner's Interpolator
+func (s *Scanner) sample(it *image.Gray, x, y float64) uint8 {
+	if s.Interpolator == nil {
+		return DefaultInterpolator.Sample(it, x, y)
+	}
+	return s.Interpolator.Sample(it, x, y)
+}
@@ -0,0 +1,89 @@
+package scan
+
+import (
+	"image"
+	"testing"
+)
+
+func TestEdgeModeIndex(t *testing.T) {
+	// image columns 0..3
+	for _, tc := range []struct {
+		edge EdgeMode
+		i    int
+		want int
+	}{
+		{EdgeClamp, -2, 0},
+		{EdgeClamp, 2, 2},
+		{EdgeClamp, 5, 3},
+		{EdgeReflect, -1, 0},
+		{EdgeReflect, -2, 1},
+		{EdgeReflect, 4, 3},
+		{EdgeReflect, 5, 2},
+		{EdgeReflect, 9, 1},
+	} {
+		if got := tc.edge.index(tc.i, 0, 4); got != tc.want {
+			t.Errorf("edge %d index(%d) = %d, want %d", tc.edge, tc.i, got, tc.want)
+		}
+	}
+}
+
+func TestInterpolators(t *testing.T) {
+	white := image.NewGray(image.Rect(0, 0, 20, 10))
+	ramp := image.NewGray(image.Rect(0, 0, 20, 10))
+	for y := 0; y < 10; y++ {
+		for x := 0; x < 20; x++ {
+			white.Pix[white.PixOffset(x, y)] = 255
+			ramp.Pix[ramp.PixOffset(x, y)] = uint8(10 * x)
+		}
+	}
+	for _, edge := range []EdgeMode{EdgeClamp, EdgeReflect} {
+		for _, in := range []Interpolator{
+			NearestInterpolator{edge},
+			BilinearInterpolator{edge},
+			CatmullRomInterpolator{edge},
+			LanczosInterpolator{Edge: edge},
+		} {
+			// a blank page is blank right up to and past its edge
+			for _, p := range [][2]float64{{0, 0}, {-0.5, 3.2}, {19.7, 9.8}, {0.6, 8.5}} {
+				if v := in.Sample(white, p[0], p[1]); v != 255 {
+					t.Errorf("%T %d white at %v = %d", in, edge, p, v)
+				}
+			}
+			want := 102
+			if _, nearest := in.(NearestInterpolator); nearest {
+				want = 100
+			}
+			if v := int(in.Sample(ramp, 10.25, 4.5)); v < want-1 || v > want+1 {
+				t.Errorf("%T %d ramp at 10.25 = %d, want %d", in, edge, v, want)
+			}
+		}
+	}
+}
+
+// Debug images show the scan as sampled for measurement, through the Scanner's Interpolator.
+func TestDebugImageInterpolator(t *testing.T) {
+	bj := synthBubbles()
+	orig := synthTemplate(&bj, 0)
+	tmpl, err := NewTemplate(&bj, orig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scan := synthScan(orig, synthRotation(0.003, 12.4, 9.7), 30)
+	s := NewScanner(tmpl)
+	s.Interpolator = NearestInterpolator{Edge: EdgeClamp}
+	s.origToScanned = synthRotation(0.003, 12.4, 9.7)
+	di := s.hotspotsDebugImage(tmpl.hotspots, scan)
+	for i, spot := range tmpl.hotspots {
+		mx := spot.center.x - (hotspotSize / 2)
+		my := spot.center.y - (hotspotSize / 2)
+		for iy := 0; iy < hotspotSize; iy++ {
+			for ix := 0; ix < hotspotSize; ix++ {
+				sx, sy := s.origToScanned.Transform(float64(mx+ix), float64(my+iy))
+				want := s.sample(scan, sx, sy)
+				if got := colorY(di.At(ix+hotspotSize, iy+(i*hotspotSize))); got != want {
+					t.Fatalf("hotspot %d (%d,%d) debug %d, sampled %d", i, ix, iy, got, want)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package scan
+
+import (
+	"image"
+	"image/color"
+)
+
+// lumaPlane converts any image into the 8 bit luminance plane that the
+// scanner works on. The returned image always has Rect.Min at (0,0).
+// Common scanner output formats are copied directly, anything else goes through color.Color.
+func lumaPlane(im image.Image) *image.Gray {
+	bounds := im.Bounds()
+	width := bounds.Dx()
+	height := bounds.Dy()
+	out := image.NewGray(image.Rect(0, 0, width, height))
+	switch it := im.(type) {
+	case *image.YCbCr:
+		for y := 0; y < height; y++ {
+			yi := it.YOffset(bounds.Min.X, bounds.Min.Y+y)
+			copy(out.Pix[y*out.Stride:y*out.Stride+width], it.Y[yi:yi+width])
+		}
+	case *image.Gray:
+		for y := 0; y < height; y++ {
+			pi := it.PixOffset(bounds.Min.X, bounds.Min.Y+y)
+			copy(out.Pix[y*out.Stride:y*out.Stride+width], it.Pix[pi:pi+width])
+		}
+	case *image.Gray16:
+		for y := 0; y < height; y++ {
+			pi := it.PixOffset(bounds.Min.X, bounds.Min.Y+y)
+			oi := y * out.Stride
+			for x := 0; x < width; x++ {
+				// high byte of big-endian 16 bit value
+				out.Pix[oi+x] = it.Pix[pi+(x*2)]
+			}
+		}
+	case *image.RGBA:
+		for y := 0; y < height; y++ {
+			pi := it.PixOffset(bounds.Min.X, bounds.Min.Y+y)
+			oi := y * out.Stride
+			for x := 0; x < width; x++ {
+				p := it.Pix[pi+(x*4) : pi+(x*4)+4]
+				out.Pix[oi+x] = premulY(uint32(p[0])*0x101, uint32(p[1])*0x101, uint32(p[2])*0x101, uint32(p[3])*0x101)
+			}
+		}
+	case *image.NRGBA:
+		for y := 0; y < height; y++ {
+			pi := it.PixOffset(bounds.Min.X, bounds.Min.Y+y)
+			oi := y * out.Stride
+			for x := 0; x < width; x++ {
+				p := it.Pix[pi+(x*4) : pi+(x*4)+4]
+				out.Pix[oi+x] = colorY(color.NRGBA{p[0], p[1], p[2], p[3]})
+			}
+		}
+	case *image.Paletted:
+		// convert the palette once, then look up each pixel
+		var pal [256]uint8
+		for i, c := range it.Palette {
+			if i >= len(pal) {
+				break
+			}
+			pal[i] = colorY(c)
+		}
+		for y := 0; y < height; y++ {
+			pi := it.PixOffset(bounds.Min.X, bounds.Min.Y+y)
+			oi := y * out.Stride
+			for x := 0; x < width; x++ {
+				out.Pix[oi+x] = pal[it.Pix[pi+x]]
+			}
+		}
+	default:
+		// *image.CMYK, *image.NYCbCrA, *image.RGBA64, ... slow but general
+		for y := 0; y < height; y++ {
+			oi := y * out.Stride
+			for x := 0; x < width; x++ {
+				out.Pix[oi+x] = colorY(im.At(bounds.Min.X+x, bounds.Min.Y+y))
+			}
+		}
+	}
+	return out
+}
+
+// premulY converts alpha-premultiplied 16 bit color components to luminance.
+// Transparent areas are treated as white paper.
+func premulY(r, g, b, a uint32) uint8 {
+	// composite over white
+	r += 0xffff - a
+	g += 0xffff - a
+	b += 0xffff - a
+	y, _, _ := color.RGBToYCbCr(uint8(r>>8), uint8(g>>8), uint8(b>>8))
+	return y
+}
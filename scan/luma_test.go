@@ -0,0 +1,73 @@
+package scan
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestLumaPlane(t *testing.T) {
+	rect := image.Rect(3, 5, 13, 12)
+	gray := image.NewGray(rect)
+	gray16 := image.NewGray16(rect)
+	rgba := image.NewRGBA(rect)
+	nrgba := image.NewNRGBA(rect)
+	cmyk := image.NewCMYK(rect)
+	pal := image.NewPaletted(rect, color.Palette{color.White, color.Black})
+	ycc := image.NewYCbCr(rect, image.YCbCrSubsampleRatio420)
+	for i := range ycc.Cb {
+		ycc.Cb[i] = 128
+		ycc.Cr[i] = 128
+	}
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			var c color.Color = color.White
+			if x == 7 && y == 9 {
+				c = color.Black
+			}
+			gray.Set(x, y, c)
+			gray16.Set(x, y, c)
+			rgba.Set(x, y, c)
+			nrgba.Set(x, y, c)
+			cmyk.Set(x, y, c)
+			pal.Set(x, y, c)
+			gv := color.GrayModel.Convert(c).(color.Gray).Y
+			ycc.Y[ycc.YOffset(x, y)] = gv
+		}
+	}
+	for _, im := range []image.Image{gray, gray16, rgba, nrgba, cmyk, pal, ycc} {
+		lp := lumaPlane(im)
+		if lp.Rect != image.Rect(0, 0, 10, 7) {
+			t.Errorf("%T: bad rect %v", im, lp.Rect)
+			continue
+		}
+		for y := 0; y < 7; y++ {
+			for x := 0; x < 10; x++ {
+				v := lp.Pix[lp.PixOffset(x, y)]
+				if x == 4 && y == 4 {
+					if v != 0 {
+						t.Errorf("%T: (%d,%d) want black got %d", im, x, y, v)
+					}
+				} else if v != 255 {
+					t.Errorf("%T: (%d,%d) want white got %d", im, x, y, v)
+				}
+			}
+		}
+	}
+}
+
+func TestOtsuThreshold(t *testing.T) {
+	// pure black ink on white paper, as a rendered template is
+	hist := make([]uint, 256)
+	hist[0] = 1000
+	hist[255] = 9000
+	if th := otsuThreshold(hist); th == 0 {
+		t.Errorf("black and white threshold %d leaves black ink light", th)
+	}
+	// black ink, grey shading and paper
+	hist[90] = 2000
+	hist[230] = 3000
+	if th := otsuThreshold(hist); th <= 90 || th > 230 {
+		t.Errorf("threshold %d, want between the shading and the paper", th)
+	}
+}
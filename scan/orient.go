@@ -0,0 +1,114 @@
+package scan
+
+import (
+	"image"
+	"math"
+)
+
+// A hotspot match this good is taken as the right orientation without trying the rest.
+const goodOrientationMatchError = 0.05
+
+// rotateGray returns the image turned clockwise by quarterTurns*90 degrees.
+func rotateGray(it *image.Gray, quarterTurns int) *image.Gray {
+	quarterTurns &= 3
+	if quarterTurns == 0 {
+		return it
+	}
+	width := it.Rect.Dx()
+	height := it.Rect.Dy()
+	var out *image.Gray
+	if quarterTurns == 2 {
+		out = image.NewGray(image.Rect(0, 0, width, height))
+	} else {
+		out = image.NewGray(image.Rect(0, 0, height, width))
+	}
+	for y := 0; y < out.Rect.Max.Y; y++ {
+		oi := y * out.Stride
+		for x := 0; x < out.Rect.Max.X; x++ {
+			var sx, sy int
+			switch quarterTurns {
+			case 1:
+				sx = y
+				sy = height - 1 - x
+			case 2:
+				sx = width - 1 - x
+				sy = height - 1 - y
+			case 3:
+				sx = width - 1 - y
+				sy = x
+			}
+			out.Pix[oi+x] = it.Pix[(sy*it.Stride)+sx]
+		}
+	}
+	return out
+}
+
+// register fits the template to the scan as it lies, by the template's registration strategy
+func (s *Scanner) register(it *image.Gray) error {
+	if s.t.registration == RegistrationFiducial {
+		return s.fiducialTransform(it)
+	}
+	err := lineFindable(it)
+	if err != nil {
+		return err
+	}
+	err = s.initialTransform(it)
+	if err != nil {
+		return err
+	}
+	return s.refineTransform(it)
+}
+
+// orient registers the scan in each of the four orientations and keeps the one whose hotspots best match the template.
+// Orientations matching the template's aspect ratio are tried first and a good enough match stops the search.
+// Returns the scan turned upright, with s.origToScanned and s.alignment set for it.
+// The TargetsPngPath debug image is written for that orientation only.
+func (s *Scanner) orient(it *image.Gray) (*image.Gray, error) {
+	orect := s.t.orig.Rect
+	origAspect := float64(orect.Dx()) / float64(orect.Dy())
+	scanAspect := float64(it.Rect.Dx()) / float64(it.Rect.Dy())
+	turns := []int{0, 2, 1, 3}
+	if math.Abs(math.Log(scanAspect*origAspect)) < math.Abs(math.Log(scanAspect/origAspect)) {
+		// sideways
+		turns = []int{1, 3, 0, 2}
+	}
+	var best *image.Gray
+	bestTurns := 0
+	var bestTransform AffineTransform
+	var bestAlignment AlignmentQuality
+	var bestTargets *image.RGBA
+	var lastErr error
+	for _, t := range turns {
+		rit := rotateGray(it, t)
+		s.targets = nil
+		err := s.register(rit)
+		if err != nil {
+			s.debug("orientation %d: %v\n", t*90, err)
+			lastErr = err
+			continue
+		}
+		s.debug("orientation %d mean match error %f\n", t*90, s.alignment.MeanMatchError)
+		if best == nil || s.alignment.MeanMatchError < bestAlignment.MeanMatchError {
+			best = rit
+			bestTurns = t
+			bestTransform = s.origToScanned
+			bestAlignment = s.alignment
+			bestTargets = s.targets
+		}
+		if bestAlignment.MeanMatchError < goodOrientationMatchError {
+			break
+		}
+	}
+	if best == nil {
+		return nil, lastErr
+	}
+	s.origToScanned = bestTransform
+	s.alignment = bestAlignment
+	s.orientation = bestTurns * 90
+	s.targets = bestTargets
+	err := s.writeTargets()
+	if err != nil {
+		return nil, err
+	}
+	return best, nil
+}
@@ -0,0 +1,131 @@
+package scan
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Sheets fed sideways or upside down are turned upright by the border and hotspot registration.
+func TestOrientBorder(t *testing.T) {
+	bj := synthBubbles()
+	orig := synthTemplate(&bj, 0)
+	synthBubble(orig, bj.Bubbles[0]["mayor"]["carol"], true)
+	synthBubble(orig, bj.Bubbles[0]["council"]["xavier"], true)
+	scan := synthScan(orig, synthRotation(0.003, 12.4, 9.7), 30)
+	tmpl, err := NewTemplate(&bj, synthTemplate(&bj, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]map[string]bool{
+		"mayor":   {"carol": true},
+		"council": {"xavier": true},
+	}
+	for turns := 1; turns < 4; turns++ {
+		result, err := NewScanner(tmpl).ProcessScannedImage(rotateGray(scan, turns))
+		if err != nil {
+			t.Errorf("fed turned %d: %v", turns*90, err)
+			continue
+		}
+		if result.Orientation != ((4-turns)%4)*90 {
+			t.Errorf("fed turned %d, orientation %d", turns*90, result.Orientation)
+		}
+		if got := result.Marked(); !reflect.DeepEqual(got, want) {
+			t.Errorf("fed turned %d: got %v, want %v", turns*90, got, want)
+		}
+	}
+}
+
+// A debug image that can't be written stops the scan, it isn't taken for a wrong orientation.
+func TestOrientDebugOutputError(t *testing.T) {
+	bj := synthBubbles()
+	orig := synthTemplate(&bj, 0)
+	tmpl, err := NewTemplate(&bj, orig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var log bytes.Buffer
+	s := NewScanner(tmpl)
+	s.DebugOut = &log
+	s.TargetsPngPath = filepath.Join("no", "such", "dir", "targets.png")
+	_, err = s.ProcessScannedImage(synthScan(orig, synthRotation(0.003, 12.4, 9.7), 30))
+	if ErrorReason(err) != ReasonDebugOutput {
+		t.Errorf("got %v, want %s", err, ReasonDebugOutput)
+	}
+	if strings.Contains(log.String(), "orientation 180") {
+		t.Errorf("went on to try other orientations")
+	}
+}
+
+// A scan too small to register in any orientation is an error from each, not a panic on the turned ones.
+func TestOrientTinyScan(t *testing.T) {
+	bj := synthBubbles()
+	tmpl, err := NewTemplate(&bj, synthTemplate(&bj, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var log bytes.Buffer
+	s := NewScanner(tmpl)
+	s.DebugOut = &log
+	_, err = s.ProcessScannedImage(image.NewGray(image.Rect(0, 0, 5, 400)))
+	if ErrorReason(err) != ReasonNoTopBorder {
+		t.Errorf("got %v, want %s", err, ReasonNoTopBorder)
+	}
+	for _, degrees := range []string{"0", "90", "180", "270"} {
+		if !strings.Contains(log.String(), "orientation "+degrees+": ") {
+			t.Errorf("orientation %s not tried", degrees)
+		}
+	}
+}
+
+// The targets debug image is of the orientation chosen, its scan patches matching the template's.
+func TestOrientTargets(t *testing.T) {
+	bj := synthBubbles()
+	orig := synthTemplate(&bj, 0)
+	tmpl, err := NewTemplate(&bj, orig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "orient")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s := NewScanner(tmpl)
+	s.TargetsPngPath = filepath.Join(dir, "targets.png")
+	result, err := s.ProcessScannedImage(rotateGray(synthScan(orig, synthRotation(0.003, 12.4, 9.7), 30), 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Orientation != 180 {
+		t.Errorf("orientation %d", result.Orientation)
+	}
+	fin, err := os.Open(s.TargetsPngPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fin.Close()
+	targets, err := png.Decode(fin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// template patches in the first column, the scan through the chosen transform in the second
+	diff := 0.0
+	bounds := targets.Bounds()
+	for y := 0; y < bounds.Max.Y; y++ {
+		for x := 0; x < hotspotSize; x++ {
+			diff += math.Abs(float64(colorY(targets.At(x, y))) - float64(colorY(targets.At(x+hotspotSize, y))))
+		}
+	}
+	diff /= float64(hotspotSize * bounds.Max.Y)
+	if diff > 32 {
+		t.Errorf("targets image scan patches differ from the template by %f on average", diff)
+	}
+}
@@ -0,0 +1,144 @@
+package scan
+
+import "fmt"
+
+const (
+	SideFront = "front"
+	SideBack  = "back"
+)
+
+// Page is one side of one sheet of a multi-page ballot.
+type Page struct {
+	// Sheet is which sheet of paper, from 0
+	Sheet int `json:"sheet"`
+
+	// Side is SideFront or SideBack
+	Side string `json:"side"`
+
+	// Bubbles is a list per ballot style of the bubbles printed on this page, like BubblesJson.Bubbles
+	Bubbles []Contest `json:"bubbles"`
+}
+
+// PageCount is the number of page images a whole ballot has.
+func (bj *BubblesJson) PageCount() int {
+	if len(bj.Pages) == 0 {
+		return 1
+	}
+	return len(bj.Pages)
+}
+
+// CheckPages makes sure Pages are in the order page images are scanned in:
+// sheet 0 front, its back if it has one, sheet 1 front, and so on.
+func (bj *BubblesJson) CheckPages() error {
+	sheet := 0
+	side := ""
+	for i, page := range bj.Pages {
+		want := SideFront
+		wantSheet := sheet
+		if i > 0 {
+			if side == SideFront && page.Side == SideBack {
+				want = SideBack
+			} else {
+				wantSheet = sheet + 1
+			}
+		}
+		if page.Sheet != wantSheet || page.Side != want {
+			return newError(ReasonTemplateLoad, nil, "page %d is sheet %d %q, expected sheet %d %s", i, page.Sheet, page.Side, wantSheet, want)
+		}
+		sheet = page.Sheet
+		side = page.Side
+	}
+	return nil
+}
+
+// pageName describes page i for people, "sheet 2 back"
+func (bj *BubblesJson) pageName(i int) string {
+	if i >= len(bj.Pages) {
+		return fmt.Sprintf("page %d", i)
+	}
+	return fmt.Sprintf("sheet %d %s", bj.Pages[i].Sheet, bj.Pages[i].Side)
+}
+
+// Page returns a single page view of the ballot for a Scanner to align one page image against.
+// For a ballot without Pages, page 0 is the whole thing.
+func (bj *BubblesJson) Page(i int) *BubblesJson {
+	if len(bj.Pages) == 0 {
+		return bj
+	}
+	return &BubblesJson{
+		DrawSettings: bj.DrawSettings,
+		Bubbles:      bj.Pages[i].Bubbles,
+		VoteFor:      bj.VoteFor,
+	}
+}
+
+// BallotResult merges the scans of every page of one ballot.
+type BallotResult struct {
+	// Contests from all pages, a contest continued across pages is tallied as one
+	Contests map[string]*ContestResult `json:"contests"`
+
+	// Style is the ballot style from the first page
+	Style int `json:"style"`
+
+	// Barcode is from the first page that had one
+	Barcode *BarcodeResult `json:"barcode,omitempty"`
+
+	// NeedsReview is true if any page needs review or the pages don't agree
+	NeedsReview bool         `json:"needs_review"`
+	Review      []ReviewFlag `json:"review,omitempty"`
+
+	Pages []*ScanResult `json:"pages"`
+}
+
+// Marked returns the selections that were marked, {contest: {selection: true}}
+// Overvoted contests are not counted and come back empty.
+func (br *BallotResult) Marked() map[string]map[string]bool {
+	sr := ScanResult{Contests: br.Contests}
+	return sr.Marked()
+}
+
+// MergePages combines page results, in page order, into one ballot.
+// Each page's review flags are kept with the page they came from.
+// A ballot short of bj.PageCount() pages is flagged for review, its missing contests can't be counted.
+func MergePages(bj *BubblesJson, pages []*ScanResult) *BallotResult {
+	out := &BallotResult{
+		Contests: make(map[string]*ContestResult),
+		Pages:    pages,
+	}
+	for i := len(pages); i < bj.PageCount(); i++ {
+		out.NeedsReview = true
+		out.Review = append(out.Review, ReviewFlag{Reason: ReviewMissingPage, Page: bj.pageName(i)})
+	}
+	for pi, page := range pages {
+		if pi == 0 {
+			out.Style = page.Style
+		} else if page.Style != out.Style {
+			out.NeedsReview = true
+			out.Review = append(out.Review, ReviewFlag{Reason: ReviewStyleMismatch, Page: bj.pageName(pi)})
+		}
+		if out.Barcode == nil {
+			out.Barcode = page.Barcode
+		}
+		if page.NeedsReview {
+			out.NeedsReview = true
+			for _, rf := range page.Review {
+				rf.Page = bj.pageName(pi)
+				out.Review = append(out.Review, rf)
+			}
+		}
+		for contestName, cr := range page.Contests {
+			merged, ok := out.Contests[contestName]
+			if !ok {
+				merged = &ContestResult{Selections: make(map[string]*BubbleResult, len(cr.Selections))}
+				out.Contests[contestName] = merged
+			}
+			for cselName, br := range cr.Selections {
+				merged.Selections[cselName] = br
+			}
+		}
+	}
+	for contestName, cr := range out.Contests {
+		cr.tally(bj.VoteFor[contestName])
+	}
+	return out
+}
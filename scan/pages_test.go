@@ -0,0 +1,97 @@
+package scan
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMergePages(t *testing.T) {
+	bj := &BubblesJson{
+		Pages:   []Page{{Sheet: 0, Side: SideFront}, {Sheet: 0, Side: SideBack}},
+		VoteFor: map[string]int{"mayor": 1, "council": 2},
+	}
+	front := &ScanResult{
+		Style: 1,
+		Contests: map[string]*ContestResult{
+			"mayor":   {Selections: map[string]*BubbleResult{"a": {Mark: MarkMarked}, "b": {Mark: MarkBlank}}},
+			"council": {Selections: map[string]*BubbleResult{"x": {Mark: MarkMarked}}},
+		},
+	}
+	back := &ScanResult{
+		Style: 1,
+		Contests: map[string]*ContestResult{
+			// council continued from the front
+			"council": {Selections: map[string]*BubbleResult{"y": {Mark: MarkMarked}, "z": {Mark: MarkMarked}}},
+		},
+	}
+	br := MergePages(bj, []*ScanResult{front, back})
+	if br.Contests["mayor"].Status != ContestOk {
+		t.Errorf("mayor %s", br.Contests["mayor"].Status)
+	}
+	if br.Contests["council"].Votes != 3 || br.Contests["council"].Status != ContestOvervote {
+		t.Errorf("council %d votes %s", br.Contests["council"].Votes, br.Contests["council"].Status)
+	}
+	if br.NeedsReview {
+		t.Errorf("unexpected review %v", br.Review)
+	}
+	back.Style = 0
+	back.NeedsReview = true
+	back.Review = []ReviewFlag{{Reason: ReviewAmbiguousMark, Contest: "council", Selection: "y"}}
+	br = MergePages(bj, []*ScanResult{front, back})
+	want := []ReviewFlag{
+		{Reason: ReviewStyleMismatch, Page: "sheet 0 back"},
+		{Reason: ReviewAmbiguousMark, Contest: "council", Selection: "y", Page: "sheet 0 back"},
+	}
+	if !br.NeedsReview || !reflect.DeepEqual(br.Review, want) {
+		t.Errorf("review %v, want %v", br.Review, want)
+	}
+	if back.Review[0].Page != "" {
+		t.Errorf("page result's own flag changed to %v", back.Review[0])
+	}
+}
+
+func TestMergeMissingPage(t *testing.T) {
+	bj := &BubblesJson{
+		Pages:   []Page{{Sheet: 0, Side: SideFront}, {Sheet: 0, Side: SideBack}, {Sheet: 1, Side: SideFront}},
+		VoteFor: map[string]int{"mayor": 1},
+	}
+	front := &ScanResult{
+		Contests: map[string]*ContestResult{
+			"mayor": {Selections: map[string]*BubbleResult{"a": {Mark: MarkMarked}}},
+		},
+	}
+	br := MergePages(bj, []*ScanResult{front})
+	want := []ReviewFlag{{Reason: ReviewMissingPage, Page: "sheet 0 back"}, {Reason: ReviewMissingPage, Page: "sheet 1 front"}}
+	if !br.NeedsReview || !reflect.DeepEqual(br.Review, want) {
+		t.Errorf("review %v, want %v", br.Review, want)
+	}
+}
+
+func TestCheckPages(t *testing.T) {
+	good := [][]Page{
+		nil,
+		{{Sheet: 0, Side: SideFront}},
+		{{Sheet: 0, Side: SideFront}, {Sheet: 0, Side: SideBack}, {Sheet: 1, Side: SideFront}, {Sheet: 1, Side: SideBack}},
+		// single sided sheets
+		{{Sheet: 0, Side: SideFront}, {Sheet: 1, Side: SideFront}},
+	}
+	bad := [][]Page{
+		{{Sheet: 0, Side: SideBack}},
+		{{Sheet: 0, Side: SideFront}, {Sheet: 1, Side: SideBack}},
+		{{Sheet: 0, Side: SideFront}, {Sheet: 0, Side: SideFront}},
+		{{Sheet: 0, Side: SideFront}, {Sheet: 2, Side: SideFront}},
+		{{Sheet: 0, Side: "top"}},
+	}
+	for _, pages := range good {
+		bj := BubblesJson{Pages: pages}
+		if err := bj.CheckPages(); err != nil {
+			t.Errorf("%v: %v", pages, err)
+		}
+	}
+	for _, pages := range bad {
+		bj := BubblesJson{Pages: pages}
+		if err := bj.CheckPages(); ErrorReason(err) != ReasonTemplateLoad {
+			t.Errorf("%v: %v", pages, err)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package scan
+
+import (
+	"image"
+	"math"
+)
+
+// levels of the coarse to fine hotspot search, each half the resolution of the one before
+const pyramidLevels = 3
+
+// search radius at the coarsest level, in its pixels: +/-44 template pixels at full resolution
+const coarseSeekRadius = 11
+
+// search radius at each finer level, around the offset found at the level above
+const fineSeekRadius = 2
+
+// halfGray shrinks an image to half size, averaging each 2x2 block.
+func halfGray(im *image.Gray) *image.Gray {
+	w := im.Rect.Dx() / 2
+	h := im.Rect.Dy() / 2
+	out := image.NewGray(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		r0 := ((2 * y) * im.Stride)
+		r1 := r0 + im.Stride
+		oi := y * out.Stride
+		for x := 0; x < w; x++ {
+			sum := uint(im.Pix[r0+(2*x)]) + uint(im.Pix[r0+(2*x)+1]) + uint(im.Pix[r1+(2*x)]) + uint(im.Pix[r1+(2*x)+1])
+			out.Pix[oi+x] = uint8((sum + 2) / 4)
+		}
+	}
+	return out
+}
+
+// grayPyramid returns levels images, the first im itself and each after half the size of the one before
+func grayPyramid(im *image.Gray, levels int) []*image.Gray {
+	out := make([]*image.Gray, levels)
+	out[0] = im
+	for i := 1; i < levels; i++ {
+		out[i] = halfGray(out[i-1])
+	}
+	return out
+}
+
+// levelToFull converts a pixel coordinate at a pyramid level to full resolution
+func levelToFull(v float64, level uint) float64 {
+	scale := float64(int(1) << level)
+	return ((v + 0.5) * scale) - 0.5
+}
+
+// fullToLevel converts a full resolution pixel coordinate to a pyramid level
+func fullToLevel(v float64, level uint) float64 {
+	scale := float64(int(1) << level)
+	return ((v + 0.5) / scale) - 0.5
+}
+
+// grayClamped is the pixel at (x,y), or the nearest one inside the image
+func grayClamped(im *image.Gray, x, y int) uint8 {
+	if x < im.Rect.Min.X {
+		x = im.Rect.Min.X
+	} else if x >= im.Rect.Max.X {
+		x = im.Rect.Max.X - 1
+	}
+	if y < im.Rect.Min.Y {
+		y = im.Rect.Min.Y
+	} else if y >= im.Rect.Max.Y {
+		y = im.Rect.Max.Y - 1
+	}
+	return im.Pix[((y-im.Rect.Min.Y)*im.Stride)+(x-im.Rect.Min.X)]
+}
+
+// scanWindow samples the scan under a square of template pixels at one pyramid level,
+// through the current transform, so patch comparisons are array lookups.
+type scanWindow struct {
+	// top left corner in template pixels at this level
+	x0, y0 int
+	size   int
+	v      []float64
+}
+
+func (s *Scanner) sampleWindow(scan *image.Gray, level uint, x0, y0, size int) scanWindow {
+	sw := scanWindow{x0: x0, y0: y0, size: size, v: make([]float64, size*size)}
+	for iy := 0; iy < size; iy++ {
+		ty := levelToFull(float64(y0+iy), level)
+		for ix := 0; ix < size; ix++ {
+			tx := levelToFull(float64(x0+ix), level)
+			sx, sy := s.origToScanned.Transform(tx, ty)
+			sw.v[(iy*size)+ix] = float64(s.sample(scan, fullToLevel(sx, level), fullToLevel(sy, level)))
+		}
+	}
+	return sw
+}
+
+// patch copies out the hotspotSize square at (x,y), in template pixels at the window's level
+func (sw *scanWindow) patch(x, y int, out []float64) {
+	for iy := 0; iy < hotspotSize; iy++ {
+		copy(out[iy*hotspotSize:(iy+1)*hotspotSize], sw.v[((y-sw.y0+iy)*sw.size)+(x-sw.x0):])
+	}
+}
+
+// matchHotspot finds how far the hotspot has moved from where the current transform puts it, in whole template pixels.
+// The offset is found on the coarsest level over a wide area by grey level SSD, each patch normalized,
+// then refined a level at a time, and finally by counting thresholded pixels that differ at full resolution.
+// mismatch is that final count.
+func (s *Scanner) matchHotspot(spot *hotspot, scanLevels []*image.Gray) (dx, dy, mismatch int) {
+	var scanPatch [hotspotSize * hotspotSize]float64
+	searched := false
+	for level := pyramidLevels - 1; level >= 1; level-- {
+		dx *= 2
+		dy *= 2
+		if !spot.coarseOk[level-1] {
+			// blank at this level
+			continue
+		}
+		radius := fineSeekRadius
+		if !searched {
+			radius = coarseSeekRadius << uint(pyramidLevels-1-level)
+			searched = true
+		}
+		// patch top left corner at this level
+		mx := (spot.center.x >> uint(level)) - (hotspotSize / 2)
+		my := (spot.center.y >> uint(level)) - (hotspotSize / 2)
+		sw := s.sampleWindow(scanLevels[level], uint(level), mx+dx-radius, my+dy-radius, hotspotSize+(2*radius))
+		bestssd := math.Inf(1)
+		bestdx, bestdy := dx, dy
+		for oy := -radius; oy <= radius; oy++ {
+			for ox := -radius; ox <= radius; ox++ {
+				sw.patch(mx+dx+ox, my+dy+oy, scanPatch[:])
+				if !normalizePatch(scanPatch[:]) {
+					continue
+				}
+				ssd := 0.0
+				for i, tv := range spot.coarse[level-1] {
+					d := tv - scanPatch[i]
+					ssd += d * d
+				}
+				if ssd < bestssd {
+					bestssd = ssd
+					bestdx = dx + ox
+					bestdy = dy + oy
+				}
+			}
+		}
+		dx = bestdx
+		dy = bestdy
+	}
+	dx *= 2
+	dy *= 2
+
+	mx := spot.center.x - (hotspotSize / 2)
+	my := spot.center.y - (hotspotSize / 2)
+	radius := fineSeekRadius
+	sw := s.sampleWindow(scanLevels[0], 0, mx+dx-radius, my+dy-radius, hotspotSize+(2*radius))
+	thresh := float64(s.scanThresh)
+	mismatch = hotspotSize*hotspotSize + 1
+	bestdx, bestdy := dx, dy
+	for oy := -radius; oy <= radius; oy++ {
+		for ox := -radius; ox <= radius; ox++ {
+			sw.patch(mx+dx+ox, my+dy+oy, scanPatch[:])
+			count := 0
+			for i, sv := range scanPatch {
+				var stv uint8
+				if sv >= thresh {
+					stv = 1
+				}
+				if stv != spot.patch[i] {
+					count++
+				}
+			}
+			// prefer the smallest move among equal counts
+			if count < mismatch || (count == mismatch && (ox*ox)+(oy*oy) < ((bestdx-dx)*(bestdx-dx))+((bestdy-dy)*(bestdy-dy))) {
+				mismatch = count
+				bestdx = dx + ox
+				bestdy = dy + oy
+			}
+		}
+	}
+	return bestdx, bestdy, mismatch
+}
@@ -0,0 +1,94 @@
+package scan
+
+import (
+	"image"
+	"testing"
+)
+
+func TestHalfGray(t *testing.T) {
+	im := image.NewGray(image.Rect(0, 0, 5, 4))
+	for i := range im.Pix {
+		im.Pix[i] = uint8(i * 10)
+	}
+	half := halfGray(im)
+	if half.Rect.Dx() != 2 || half.Rect.Dy() != 2 {
+		t.Fatalf("half of %v is %v", im.Rect, half.Rect)
+	}
+	// (0+10+50+60)/4
+	if half.Pix[0] != 30 {
+		t.Errorf("half[0,0] = %d, want 30", half.Pix[0])
+	}
+	// (120+130+170+180)/4
+	if half.Pix[half.Stride+1] != 150 {
+		t.Errorf("half[1,1] = %d, want 150", half.Pix[half.Stride+1])
+	}
+}
+
+// Starting 41 px away from the truth, the coarse search should still find every hotspot.
+func TestRefineTransformFarOff(t *testing.T) {
+	bj := synthBubbles()
+	orig := synthTemplate(&bj, 0)
+	truth := synthRotation(0.002, 8.6, 11.2)
+	scan := synthScan(orig, truth, 40)
+	tmpl, err := NewTemplate(&bj, orig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewScanner(tmpl)
+	s.scanThresh = otsuThreshold(yHistogram(scan))
+	s.origToScanned = synthRotation(0.002, 8.6+31, 11.2-27)
+	err = s.refineTransform(scan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := synthHotspotError(&s.alignment, truth); e > 0.25 {
+		t.Errorf("median hotspot error %f px", e)
+	}
+	if s.alignment.WorstMatchError > 0.1 {
+		t.Errorf("worst match error %f", s.alignment.WorstMatchError)
+	}
+}
+
+func BenchmarkRefineTransform(b *testing.B) {
+	bj := synthBubbles()
+	orig := synthTemplate(&bj, 0)
+	scan := synthScan(orig, synthRotation(0.004, 21.37, 14.62), 40)
+	tmpl, err := NewTemplate(&bj, orig)
+	if err != nil {
+		b.Fatal(err)
+	}
+	s := NewScanner(tmpl)
+	s.scanThresh = otsuThreshold(yHistogram(scan))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err = s.topLine(scan)
+		if err == nil {
+			err = s.refineTransform(scan)
+		}
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// A scan that is the template itself matches every hotspot in place with nothing different,
+// even when the threshold is the paper white of a pure black and white page.
+func TestMatchHotspotExact(t *testing.T) {
+	bj := synthBubbles()
+	orig := synthTemplate(&bj, 0)
+	tmpl, err := NewTemplate(&bj, orig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewScanner(tmpl)
+	s.scanThresh = otsuThreshold(yHistogram(orig))
+	s.origToScanned = synthRotation(0, 0, 0)
+	levels := grayPyramid(orig, pyramidLevels)
+	for i := range tmpl.hotspots {
+		spot := &tmpl.hotspots[i]
+		dx, dy, mismatch := s.matchHotspot(spot, levels)
+		if dx != 0 || dy != 0 || mismatch != 0 {
+			t.Errorf("hotspot at %v moved (%d,%d) with %d px different", spot.center, dx, dy, mismatch)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package scan
+
+import (
+	"math"
+)
+
+// HotspotMatch is where one template hotspot was found on the scan.
+type HotspotMatch struct {
+	// hotspot center in template pixels
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+
+	// best match location in scan pixels
+	ScanX float64 `json:"sx"`
+	ScanY float64 `json:"sy"`
+
+	// fraction of hotspot pixels that disagreed with the template at the best match
+	MatchError float64 `json:"match_error"`
+
+	// distance in scan pixels between the best match and where the fitted transform puts the hotspot
+	Residual float64 `json:"residual"`
+
+	// Outlier is true if the match disagreed with the other hotspots and was left out of the fit
+	Outlier bool `json:"outlier,omitempty"`
+}
+
+// AlignmentQuality summarizes how well the template fits the scan.
+type AlignmentQuality struct {
+	Hotspots []HotspotMatch `json:"hotspots"`
+
+	// MatchError averaged over hotspots
+	MeanMatchError float64 `json:"mean_match_error"`
+
+	// MatchError of the worst hotspot
+	WorstMatchError float64 `json:"worst_match_error"`
+
+	// number of hotspots that were not outliers
+	Inliers int `json:"inliers"`
+
+	// root mean square and largest hotspot Residual over inliers, scan pixels
+	ReprojectionRMS float64 `json:"reprojection_rms"`
+	ReprojectionMax float64 `json:"reprojection_max"`
+
+	// scan pixels per template pixel along the template's x and y axes
+	ScaleX float64 `json:"scale_x"`
+	ScaleY float64 `json:"scale_y"`
+
+	// cosine of the angle between the transformed template axes, 0 for no skew
+	Skew float64 `json:"skew"`
+
+	// number of hotspots Scanner.LocalWarp fitted its spline through, 0 if there was no local warp
+	WarpPoints int `json:"warp_points,omitempty"`
+
+	// largest distance the local warp moved a hotspot from the global fit, scan pixels
+	WarpMax float64 `json:"warp_max,omitempty"`
+}
+
+// AlignmentLimits reject a scan whose alignment is too poor to trust the bubbles read from it.
+// A zero field uses the value from DefaultAlignmentLimits.
+type AlignmentLimits struct {
+	MaxMeanMatchError  float64 `json:"max_mean_match_error"`
+	MaxReprojectionRMS float64 `json:"max_reprojection_rms"`
+
+	// a hotspot match further than this from the fit, in scan pixels, is an outlier and left out of it
+	MaxInlierResidual float64 `json:"max_inlier_residual"`
+
+	// fewer hotspots than this fraction agreeing on the fit means something is badly wrong
+	MinInlierFraction float64 `json:"min_inlier_fraction"`
+
+	// |ScaleY/ScaleX - 1|, paper doesn't stretch much
+	MaxAspectError float64 `json:"max_aspect_error"`
+	MaxSkew        float64 `json:"max_skew"`
+
+	// scan resolution relative to the template
+	MinScale float64 `json:"min_scale"`
+	MaxScale float64 `json:"max_scale"`
+}
+
+var DefaultAlignmentLimits = AlignmentLimits{
+	MaxMeanMatchError:  0.15,
+	MaxReprojectionRMS: 3.0,
+	MaxInlierResidual:  2.0,
+	MinInlierFraction:  0.5,
+	MaxAspectError:     0.05,
+	MaxSkew:            0.05,
+	MinScale:           0.25,
+	MaxScale:           8.0,
+}
+
+func (al AlignmentLimits) orDefault() AlignmentLimits {
+	def := DefaultAlignmentLimits
+	if al.MaxMeanMatchError == 0 {
+		al.MaxMeanMatchError = def.MaxMeanMatchError
+	}
+	if al.MaxReprojectionRMS == 0 {
+		al.MaxReprojectionRMS = def.MaxReprojectionRMS
+	}
+	if al.MaxInlierResidual == 0 {
+		al.MaxInlierResidual = def.MaxInlierResidual
+	}
+	if al.MinInlierFraction == 0 {
+		al.MinInlierFraction = def.MinInlierFraction
+	}
+	if al.MaxAspectError == 0 {
+		al.MaxAspectError = def.MaxAspectError
+	}
+	if al.MaxSkew == 0 {
+		al.MaxSkew = def.MaxSkew
+	}
+	if al.MinScale == 0 {
+		al.MinScale = def.MinScale
+	}
+	if al.MaxScale == 0 {
+		al.MaxScale = def.MaxScale
+	}
+	return al
+}
+
+// measureFit fills in the residuals of hotspot matches against the fitted transform,
+// and the scale and skew of the transform at the center of the template.
+func (aq *AlignmentQuality) measureFit(fit AffineTransform, cx, cy float64) {
+	sumsq := 0.0
+	aq.ReprojectionMax = 0
+	aq.Inliers = 0
+	for i := range aq.Hotspots {
+		hm := &aq.Hotspots[i]
+		fx, fy := fit.Transform(hm.X, hm.Y)
+		hm.Residual = math.Hypot(fx-hm.ScanX, fy-hm.ScanY)
+		if hm.Outlier {
+			continue
+		}
+		aq.Inliers++
+		sumsq += hm.Residual * hm.Residual
+		aq.ReprojectionMax = fmax(aq.ReprojectionMax, hm.Residual)
+	}
+	if aq.Inliers > 0 {
+		aq.ReprojectionRMS = math.Sqrt(sumsq / float64(aq.Inliers))
+	}
+
+	// local Jacobian by finite difference, works for any transform
+	ox, oy := fit.Transform(cx, cy)
+	xx, xy := fit.Transform(cx+1, cy)
+	yx, yy := fit.Transform(cx, cy+1)
+	ax := xx - ox
+	ay := xy - oy
+	bx := yx - ox
+	by := yy - oy
+	aq.ScaleX = math.Hypot(ax, ay)
+	aq.ScaleY = math.Hypot(bx, by)
+	if aq.ScaleX > 0 && aq.ScaleY > 0 {
+		aq.Skew = ((ax * bx) + (ay * by)) / (aq.ScaleX * aq.ScaleY)
+	}
+}
+
+// check returns a ReasonMisaligned error if the alignment is outside limits
+func (aq *AlignmentQuality) check(limits AlignmentLimits) error {
+	limits = limits.orDefault()
+	if aq.MeanMatchError > limits.MaxMeanMatchError {
+		return newError(ReasonMisaligned, nil, "hotspot match error %f > %f", aq.MeanMatchError, limits.MaxMeanMatchError)
+	}
+	if float64(aq.Inliers) < limits.MinInlierFraction*float64(len(aq.Hotspots)) {
+		return newError(ReasonMisaligned, nil, "only %d of %d hotspots agree", aq.Inliers, len(aq.Hotspots))
+	}
+	if aq.ReprojectionRMS > limits.MaxReprojectionRMS {
+		return newError(ReasonMisaligned, nil, "reprojection error %f px > %f", aq.ReprojectionRMS, limits.MaxReprojectionRMS)
+	}
+	if aq.ScaleX < limits.MinScale || aq.ScaleX > limits.MaxScale || aq.ScaleY < limits.MinScale || aq.ScaleY > limits.MaxScale {
+		return newError(ReasonMisaligned, nil, "scale (%f,%f) outside %f..%f", aq.ScaleX, aq.ScaleY, limits.MinScale, limits.MaxScale)
+	}
+	if math.Abs((aq.ScaleY/aq.ScaleX)-1) > limits.MaxAspectError {
+		return newError(ReasonMisaligned, nil, "aspect %f", aq.ScaleY/aq.ScaleX)
+	}
+	if math.Abs(aq.Skew) > limits.MaxSkew {
+		return newError(ReasonMisaligned, nil, "skew %f", aq.Skew)
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+package scan
+
+import "testing"
+
+func TestAlignmentCheck(t *testing.T) {
+	hotspots := []HotspotMatch{{X: 10, Y: 10, ScanX: 21, ScanY: 31}, {X: 500, Y: 20, ScanX: 511, ScanY: 41}, {X: 30, Y: 700, ScanX: 41, ScanY: 721}}
+	good := &MatrixTransform{[]float64{1, 0, 11, 0, 1, 21, 0, 0, 1}}
+	aq := AlignmentQuality{Hotspots: hotspots}
+	aq.measureFit(good, 300, 400)
+	if aq.ReprojectionRMS > 1e-9 || aq.Skew != 0 {
+		t.Errorf("good fit rms=%f skew=%f", aq.ReprojectionRMS, aq.Skew)
+	}
+	if err := aq.check(AlignmentLimits{}); err != nil {
+		t.Errorf("good fit rejected: %v", err)
+	}
+
+	sheared := &MatrixTransform{[]float64{1, 0.2, 11, 0, 1, 21, 0, 0, 1}}
+	aq = AlignmentQuality{Hotspots: hotspots}
+	aq.measureFit(sheared, 300, 400)
+	err := aq.check(AlignmentLimits{MaxReprojectionRMS: 1000})
+	if ErrorReason(err) != ReasonMisaligned {
+		t.Errorf("sheared fit not rejected, skew=%f err=%v", aq.Skew, err)
+	}
+	err = aq.check(AlignmentLimits{})
+	if ErrorReason(err) != ReasonMisaligned {
+		t.Errorf("sheared fit residuals not rejected, rms=%f err=%v", aq.ReprojectionRMS, err)
+	}
+}
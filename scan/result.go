@@ -0,0 +1,197 @@
+package scan
+
+// MarkClass is the verdict on one bubble.
+type MarkClass string
+
+const (
+	MarkBlank     MarkClass = "blank"
+	MarkMarked    MarkClass = "marked"
+	MarkAmbiguous MarkClass = "ambiguous"
+)
+
+// FillBand is the range of bubble fill fractions that are neither clearly blank nor clearly marked.
+// Fill below Low is blank, above High is marked, and anything in between is ambiguous.
+type FillBand struct {
+	Low  float64 `json:"low"`
+	High float64 `json:"high"`
+}
+
+// DefaultFillBand fills in whichever of Low and High a Scanner's FillBand leaves zero.
+var DefaultFillBand = FillBand{Low: 0.3, High: 0.7}
+
+func (fb FillBand) classify(fill float64) (mark MarkClass, confidence float64) {
+	if fill > fb.High {
+		return MarkMarked, (fill - fb.High) / (1.0 - fb.High)
+	}
+	if fill < fb.Low {
+		return MarkBlank, (fb.Low - fill) / fb.Low
+	}
+	return MarkAmbiguous, 0
+}
+
+// BubbleResult is the measurement of one selection's bubble.
+type BubbleResult struct {
+	// number of samples darker than the scan threshold
+	DarkCount int `json:"dark"`
+	// number of samples taken, leaving out those where the template is printed
+	PxCount int `json:"px"`
+
+	// area of the bubble sampled and of the dark part of it, in template pixels
+	DarkArea float64 `json:"dark_area"`
+	Area     float64 `json:"area"`
+
+	// DarkArea/Area
+	Fill float64 `json:"fill"`
+
+	// 0.0 (at the edge of the ambiguous band) .. 1.0 (as far from it as possible).
+	// Ambiguous bubbles always have confidence 0.
+	Confidence float64 `json:"confidence"`
+
+	Mark MarkClass `json:"mark"`
+
+	// Shape is what kind of mark was made, empty for no ink
+	Shape MarkShape `json:"shape,omitempty"`
+
+	// Unreadable is true when so much of the bubble is printed that a mark in it can't be measured.
+	// Mark is then ambiguous.
+	Unreadable bool `json:"unreadable,omitempty"`
+
+	// WriteIn is the write-in space next to a write-in bubble that was marked or written in, nil otherwise
+	WriteIn *WriteInCrop `json:"write_in,omitempty"`
+}
+
+// ContestStatus is the verdict on one contest.
+type ContestStatus string
+
+const (
+	// ContestOk has as many marks as allowed, or some marks and no known limit
+	ContestOk ContestStatus = "ok"
+	// ContestOvervote has more marks than allowed and is not counted
+	ContestOvervote ContestStatus = "overvote"
+	// ContestUndervote has some marks but fewer than allowed
+	ContestUndervote ContestStatus = "undervote"
+	// ContestBlank has no marks
+	ContestBlank ContestStatus = "blank"
+)
+
+// ContestResult holds the bubbles of one contest.
+type ContestResult struct {
+	Selections map[string]*BubbleResult `json:"selections"`
+
+	// VoteFor is the number of selections allowed, 0 if unknown
+	VoteFor int `json:"vote_for,omitempty"`
+
+	// Votes is the number of marked selections
+	Votes int `json:"votes"`
+
+	Status ContestStatus `json:"status"`
+
+	// Counted is false for overvoted contests, whose marks must not be tallied
+	Counted bool `json:"counted"`
+}
+
+// tally counts marked selections against the "vote for N" limit
+func (cr *ContestResult) tally(voteFor int) {
+	cr.VoteFor = voteFor
+	cr.Votes = 0
+	for _, br := range cr.Selections {
+		if br.Mark == MarkMarked {
+			cr.Votes++
+		}
+	}
+	switch {
+	case cr.Votes == 0:
+		cr.Status = ContestBlank
+	case voteFor <= 0:
+		cr.Status = ContestOk
+	case cr.Votes > voteFor:
+		cr.Status = ContestOvervote
+	case cr.Votes < voteFor:
+		cr.Status = ContestUndervote
+	default:
+		cr.Status = ContestOk
+	}
+	cr.Counted = cr.Status != ContestOvervote
+}
+
+// ScanResult is everything measured on one scanned ballot page.
+type ScanResult struct {
+	Contests map[string]*ContestResult `json:"contests"`
+
+	// Transform is the row-major 3x3 matrix from template pixels to scan pixels, the global fit before any local warp
+	Transform []float64 `json:"transform,omitempty"`
+
+	Alignment AlignmentQuality `json:"alignment"`
+
+	// Orientation is how many degrees clockwise the scan was turned to match the template: 0, 90, 180 or 270
+	Orientation int `json:"orientation"`
+
+	// Style is the index of the ballot style identified on this sheet, into BubblesJson.Bubbles
+	Style int `json:"style"`
+
+	// StyleScores is how well each ballot style matched, 0..1. Empty when there is only one style.
+	StyleScores []float64 `json:"style_scores,omitempty"`
+
+	// Barcode is the decoded ballot barcode, nil if the template has none or it could not be read
+	Barcode *BarcodeResult `json:"barcode,omitempty"`
+
+	// NeedsReview is true if a human should look at this ballot before it is counted
+	NeedsReview bool         `json:"needs_review"`
+	Review      []ReviewFlag `json:"review,omitempty"`
+}
+
+// ReviewFlag is one reason a ballot needs human review.
+type ReviewFlag struct {
+	Reason    string `json:"reason"`
+	Contest   string `json:"contest,omitempty"`
+	Selection string `json:"selection,omitempty"`
+
+	// Page is the page of a multi-page ballot the flag is for, "sheet 0 back", set by MergePages
+	Page string `json:"page,omitempty"`
+}
+
+const (
+	ReviewAmbiguousMark = "ambiguous_mark"
+	// ReviewUnreadableBubble is a bubble so printed over on the template that marks in it can't be measured
+	ReviewUnreadableBubble = "unreadable_bubble"
+	// ReviewUnusualMark is a check, X, line, loop or other mark that isn't a filled bubble, for voter-intent rules
+	ReviewUnusualMark = "unusual_mark"
+	// ReviewWriteIn is a write-in to read, see BubbleResult.WriteIn
+	ReviewWriteIn       = "write_in"
+	ReviewUnknownStyle  = "unknown_style"
+	ReviewStyleMismatch = "style_mismatch"
+	// ReviewMissingPage is a page of a multi-page ballot that wasn't scanned
+	ReviewMissingPage = "missing_page"
+)
+
+func (sr *ScanResult) flagReview(reason, contest, selection string) {
+	sr.NeedsReview = true
+	sr.Review = append(sr.Review, ReviewFlag{Reason: reason, Contest: contest, Selection: selection})
+}
+
+// Marked returns the selections that were marked, {contest: {selection: true}}
+// Overvoted contests are not counted and come back empty.
+func (sr *ScanResult) Marked() map[string]map[string]bool {
+	marked := make(map[string]map[string]bool, len(sr.Contests))
+	for contestName, cr := range sr.Contests {
+		conout := make(map[string]bool)
+		if cr.Counted {
+			for cselName, br := range cr.Selections {
+				if br.Mark == MarkMarked {
+					conout[cselName] = true
+				}
+			}
+		}
+		marked[contestName] = conout
+	}
+	return marked
+}
+
+// classify sets Fill from the measured areas, and Mark and Confidence from it by band
+func (br *BubbleResult) classify(band FillBand) {
+	br.Fill = 0
+	if br.Area > 0 {
+		br.Fill = br.DarkArea / br.Area
+	}
+	br.Mark, br.Confidence = band.classify(br.Fill)
+}
@@ -0,0 +1,183 @@
+package scan
+
+import (
+	"encoding/json"
+	"math"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestContestTally(t *testing.T) {
+	cases := []struct {
+		marks   []MarkClass
+		voteFor int
+		status  ContestStatus
+		counted bool
+	}{
+		{[]MarkClass{MarkBlank, MarkBlank}, 1, ContestBlank, true},
+		{[]MarkClass{MarkMarked, MarkBlank}, 1, ContestOk, true},
+		{[]MarkClass{MarkMarked, MarkMarked}, 1, ContestOvervote, false},
+		{[]MarkClass{MarkMarked, MarkAmbiguous, MarkBlank}, 2, ContestUndervote, true},
+		{[]MarkClass{MarkMarked, MarkMarked, MarkMarked}, 0, ContestOk, true},
+		{[]MarkClass{MarkAmbiguous}, 1, ContestBlank, true},
+	}
+	names := []string{"a", "b", "c"}
+	for i, tc := range cases {
+		cr := ContestResult{Selections: make(map[string]*BubbleResult)}
+		for j, m := range tc.marks {
+			cr.Selections[names[j]] = &BubbleResult{Mark: m}
+		}
+		cr.tally(tc.voteFor)
+		if cr.Status != tc.status || cr.Counted != tc.counted {
+			t.Errorf("[%d] got %s counted=%v, want %s counted=%v", i, cr.Status, cr.Counted, tc.status, tc.counted)
+		}
+	}
+}
+
+func TestFillBandClassify(t *testing.T) {
+	band := FillBand{Low: 0.2, High: 0.6}
+	cases := []struct {
+		fill       float64
+		mark       MarkClass
+		confidence float64
+	}{
+		{0, MarkBlank, 1},
+		{0.1, MarkBlank, 0.5},
+		{0.2, MarkAmbiguous, 0},
+		{0.4, MarkAmbiguous, 0},
+		{0.6, MarkAmbiguous, 0},
+		{0.8, MarkMarked, 0.5},
+		{1, MarkMarked, 1},
+	}
+	for _, tc := range cases {
+		mark, confidence := band.classify(tc.fill)
+		if mark != tc.mark || math.Abs(confidence-tc.confidence) > 1e-9 {
+			t.Errorf("fill %.1f: got %s %f, want %s %f", tc.fill, mark, confidence, tc.mark, tc.confidence)
+		}
+	}
+}
+
+func TestScannerFillBand(t *testing.T) {
+	cases := []struct {
+		set, want FillBand
+	}{
+		{FillBand{}, DefaultFillBand},
+		{FillBand{Low: 0.4}, FillBand{Low: 0.4, High: DefaultFillBand.High}},
+		{FillBand{High: 0.5}, FillBand{Low: DefaultFillBand.Low, High: 0.5}},
+		{FillBand{Low: 0.1, High: 0.9}, FillBand{Low: 0.1, High: 0.9}},
+	}
+	for _, tc := range cases {
+		s := Scanner{FillBand: tc.set}
+		if got := s.fillBand(); got != tc.want {
+			t.Errorf("%v: got %v, want %v", tc.set, got, tc.want)
+		}
+	}
+}
+
+// A half filled bubble is neither marked nor blank, and is flagged for review.
+func TestAmbiguousMarkReview(t *testing.T) {
+	bj := synthBubbles()
+	tmpl, err := NewTemplate(&bj, synthTemplate(&bj, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	orig := synthTemplate(&bj, 0)
+	synthBubble(orig, bj.Bubbles[0]["mayor"]["alice"], true)
+	xywh := bj.Bubbles[0]["mayor"]["bob"]
+	synthBubble(orig, xywh, true)
+	// clear the right half
+	x := int((xywh[0] + (xywh[2] / 2)) * synthPxPerPt)
+	y := orig.Rect.Max.Y - int((xywh[1]+xywh[3])*synthPxPerPt)
+	synthFill(orig, x, y-3, x+int(xywh[2]*synthPxPerPt/2)+3, y+int(xywh[3]*synthPxPerPt)+3, 255)
+	result, err := NewScanner(tmpl).ProcessScannedImage(synthScan(orig, synthRotation(0.003, 12.4, 9.7), 30))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mayor := result.Contests["mayor"].Selections
+	if br := mayor["alice"]; br.Mark != MarkMarked || br.Confidence < 0.5 {
+		t.Errorf("filled bubble %s fill %f confidence %f", br.Mark, br.Fill, br.Confidence)
+	}
+	if br := mayor["bob"]; br.Mark != MarkAmbiguous || br.Confidence != 0 {
+		t.Errorf("half filled bubble %s fill %f confidence %f", br.Mark, br.Fill, br.Confidence)
+	}
+	if br := mayor["carol"]; br.Mark != MarkBlank || br.Confidence < 0.5 {
+		t.Errorf("blank bubble %s fill %f confidence %f", br.Mark, br.Fill, br.Confidence)
+	}
+	want := []ReviewFlag{{Reason: ReviewAmbiguousMark, Contest: "mayor", Selection: "bob"}}
+	if !reflect.DeepEqual(result.Review, want) {
+		t.Errorf("review %v, want %v", result.Review, want)
+	}
+}
+
+func jsonKeys(t *testing.T, raw json.RawMessage) []string {
+	var ob map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &ob); err != nil {
+		t.Fatal(err)
+	}
+	keys := make([]string, 0, len(ob))
+	for k := range ob {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// The result of a scan as the server returns it, contest by contest and bubble by bubble.
+func TestScanResult(t *testing.T) {
+	bj := synthBubbles()
+	tmpl, err := NewTemplate(&bj, synthTemplate(&bj, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	orig := synthTemplate(&bj, 0)
+	synthBubble(orig, bj.Bubbles[0]["mayor"]["alice"], true)
+	synthBubble(orig, bj.Bubbles[0]["council"]["xavier"], true)
+	synthBubble(orig, bj.Bubbles[0]["council"]["yolanda"], true)
+	result, err := NewScanner(tmpl).ProcessScannedImage(synthScan(orig, synthRotation(0.003, 12.4, 9.7), 30))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mayor := result.Contests["mayor"]
+	if mayor.VoteFor != 1 || mayor.Votes != 1 || mayor.Status != ContestOk || !mayor.Counted {
+		t.Errorf("mayor %+v", mayor)
+	}
+	council := result.Contests["council"]
+	if council.VoteFor != 1 || council.Votes != 2 || council.Status != ContestOvervote || council.Counted {
+		t.Errorf("council %+v", council)
+	}
+	for name, br := range mayor.Selections {
+		if (br.Mark == MarkMarked) != (name == "alice") || br.PxCount == 0 || br.Area == 0 || br.Confidence < 0.5 {
+			t.Errorf("mayor %s %+v", name, br)
+		}
+	}
+	if result.Orientation != 0 || result.NeedsReview || len(result.Transform) != 9 {
+		t.Errorf("orientation %d review %v transform %v", result.Orientation, result.Review, result.Transform)
+	}
+
+	jb, err := json.Marshal(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := jsonKeys(t, jb), []string{"alignment", "contests", "needs_review", "orientation", "style", "style_scores", "transform"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("result keys %v, want %v", got, want)
+	}
+	var out struct {
+		Contests map[string]json.RawMessage `json:"contests"`
+	}
+	if err := json.Unmarshal(jb, &out); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := jsonKeys(t, out.Contests["mayor"]), []string{"counted", "selections", "status", "vote_for", "votes"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("contest keys %v, want %v", got, want)
+	}
+	var contest struct {
+		Selections map[string]json.RawMessage `json:"selections"`
+	}
+	if err := json.Unmarshal(out.Contests["mayor"], &contest); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := jsonKeys(t, contest.Selections["alice"]), []string{"area", "confidence", "dark", "dark_area", "fill", "mark", "px", "shape"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("bubble keys %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,68 @@
+package scan
+
+import (
+	"math"
+)
+
+// SampleGrid is how a bubble is sampled for measurement: a grid of points over its whole rectangle,
+// or the part of it inside the inscribed oval, each point standing for the area of its grid cell.
+type SampleGrid struct {
+	// Step is the spacing of samples across and down the bubble, in points.
+	// The grid is stretched a little so a whole number of cells covers the bubble exactly.
+	Step float64 `json:"step"`
+
+	// Ellipse keeps to the oval inscribed in the bubble rectangle.
+	// Cells on the edge of the oval count for the part of their area inside it.
+	Ellipse bool `json:"ellipse"`
+}
+
+// DefaultSampleGrid is used when a Scanner has no SampleGrid set.
+var DefaultSampleGrid = SampleGrid{Step: 0.5, Ellipse: true}
+
+func (s *Scanner) sampleGrid() SampleGrid {
+	if s.SampleGrid.Step <= 0 {
+		return DefaultSampleGrid
+	}
+	return s.SampleGrid
+}
+
+// cells calls fn with the center of each grid cell over r, in template pixels, and the area of the cell to count, in template pixels
+func (g SampleGrid) cells(r pxRect, pxPerPt float64, fn func(x, y, area float64)) {
+	step := g.Step * pxPerPt
+	nx := int(math.Max(1, math.Ceil(r.w/step)))
+	ny := int(math.Max(1, math.Ceil(r.h/step)))
+	cw := r.w / float64(nx)
+	ch := r.h / float64(ny)
+	cellArea := cw * ch
+	cellSize := math.Sqrt(cellArea)
+	rx := r.w / 2
+	ry := r.h / 2
+	ex := r.x + rx
+	ey := r.y + ry
+	for iy := 0; iy < ny; iy++ {
+		y := r.y + ((float64(iy) + 0.5) * ch)
+		for ix := 0; ix < nx; ix++ {
+			x := r.x + ((float64(ix) + 0.5) * cw)
+			coverage := 1.0
+			if g.Ellipse {
+				coverage = ellipseCoverage((x-ex)/rx, (y-ey)/ry, rx, ry, cellSize)
+				if coverage <= 0 {
+					continue
+				}
+			}
+			fn(x, y, coverage*cellArea)
+		}
+	}
+}
+
+// ellipseCoverage estimates how much of a cell cellSize across is inside an ellipse with radii rx,ry,
+// the cell's center at (u*rx, v*ry) from the ellipse's center.
+// It goes by the distance to the edge from f = u^2 + v^2 - 1 over the length of its gradient.
+func ellipseCoverage(u, v, rx, ry, cellSize float64) float64 {
+	f := (u * u) + (v * v) - 1
+	grad := 2 * math.Hypot(u/rx, v/ry)
+	if grad == 0 {
+		return 1
+	}
+	return fclamp(0.5-((f/grad)/cellSize), 0, 1)
+}
@@ -0,0 +1,73 @@
+package scan
+
+import (
+	"math"
+	"testing"
+)
+
+func TestSampleGridArea(t *testing.T) {
+	r := pxRect{x: 10.3, y: 20.7, w: 45.8, h: 20.8}
+	for _, step := range []float64{0.25, 0.5, 1.5} {
+		for _, ellipse := range []bool{false, true} {
+			g := SampleGrid{Step: step, Ellipse: ellipse}
+			area := 0.0
+			g.cells(r, synthPxPerPt, func(x, y, a float64) {
+				if x < r.x || x > r.x+r.w || y < r.y || y > r.y+r.h {
+					t.Errorf("%v sample (%f,%f) outside the bubble", g, x, y)
+				}
+				area += a
+			})
+			want := r.w * r.h
+			if ellipse {
+				want = math.Pi * r.w * r.h / 4
+			}
+			if math.Abs(area-want)/want > 0.02 {
+				t.Errorf("%v area %f, want %f", g, area, want)
+			}
+		}
+	}
+}
+
+// A pen stroke through a bubble, too thin to mark it, still shows up wherever it crosses.
+// This one falls between the columns sampled by the old three-row pattern.
+func TestSampleGridStroke(t *testing.T) {
+	bj := synthBubbles()
+	orig := synthTemplate(&bj, 0)
+	synthBubble(orig, bj.Bubbles[0]["mayor"]["bob"], true)
+	alice := bj.Bubbles[0]["mayor"]["alice"]
+	sx := int((alice[0] + 6.6) * synthPxPerPt)
+	sy := orig.Rect.Max.Y - int((alice[1]+alice[3])*synthPxPerPt)
+	synthFill(orig, sx, sy+2, sx+2, sy+int(alice[3]*synthPxPerPt)-2, 0)
+	scan := synthScan(orig, synthRotation(0.003, 12.4, 9.7), 30)
+	tmpl, err := NewTemplate(&bj, synthTemplate(&bj, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fills []float64
+	for _, g := range []SampleGrid{{Step: 0.5, Ellipse: true}, {Step: 0.25, Ellipse: true}, {Step: 0.5}} {
+		s := NewScanner(tmpl)
+		s.SampleGrid = g
+		result, err := s.ProcessScannedImage(scan)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stroke := result.Contests["mayor"].Selections["alice"]
+		if stroke.Mark != MarkBlank || stroke.DarkArea == 0 {
+			t.Errorf("%v stroke %s dark area %f, want blank and some dark", g, stroke.Mark, stroke.DarkArea)
+		}
+		filled := result.Contests["mayor"].Selections["bob"]
+		if filled.Mark != MarkMarked {
+			t.Errorf("%v filled bubble %s", g, filled.Mark)
+		}
+		if g.Ellipse {
+			fills = append(fills, stroke.Fill)
+			// nothing outside the oval to dilute the fill
+			if filled.Fill < 0.95 {
+				t.Errorf("%v filled bubble fill %f", g, filled.Fill)
+			}
+		}
+	}
+	if math.Abs(fills[0]-fills[1]) > 0.02 {
+		t.Errorf("stroke fill %f at step 0.5, %f at step 0.25", fills[0], fills[1])
+	}
+}
@@ -1,7 +1,6 @@
 package scan
 
 import (
-	"encoding/json"
 	"fmt"
 	"image"
 	"image/color"
@@ -10,28 +9,15 @@ import (
 	_ "image/png"
 	"io"
 	"math"
-	"math/rand"
 	"os"
 	"sort"
 )
 
-func maybeFail(err error, format string, args ...interface{}) {
-	if err == nil {
-		return
-	}
-	fmt.Fprintf(os.Stderr, format, args...)
-	os.Exit(1)
-}
-
-// func pxy(it *image.YCbCr, x, y int) {
-// 	fmt.Printf("(%d,%d) Y=%d, (%d,%d) CrCb=%d\n", x, y, it.YOffset(x, y), x, y, it.COffset(x, y))
-// }
-
-func yHistogram(it *image.YCbCr) []uint {
+func yHistogram(it *image.Gray) []uint {
 	out := make([]uint, 256)
 	for y := 0; y < it.Rect.Max.Y; y++ {
 		for x := 0; x < it.Rect.Max.X; x++ {
-			yv := it.Y[(it.YStride*y)+x]
+			yv := it.Pix[(it.Stride*y)+x]
 			out[yv]++
 		}
 	}
@@ -68,6 +54,8 @@ func otsuThreshold(hist []uint) uint8 {
 		total += hv
 		sum1 += uint(i) * hv
 	}
+	// background class is [0,i), start it with the zero bucket
+	wB = hist[0]
 	for i := 1; i < 256; i++ {
 		if wB > 0 && total > wB {
 			wF := total - wB
@@ -89,14 +77,25 @@ func otsuThreshold(hist []uint) uint8 {
 
 const darkPxCountThreshold = 4
 
-// Search the Y compoment of YCbCr for a left edge
-func yLeftLineFind(it *image.YCbCr, ySeekCenter int, threshold uint8) (edgeX int) {
+// the line finders look this many pixels into the image from its edge at once
+const lineFindSpan = 10
+
+// lineFindable is an error for an image too small for the line finders to search
+func lineFindable(it *image.Gray) error {
+	if it.Rect.Dx() < lineFindSpan || it.Rect.Dy() < lineFindSpan {
+		return newError(ReasonNoTopBorder, nil, "image %v too small to find a border in", it.Rect)
+	}
+	return nil
+}
+
+// Search the luminance plane for a left edge
+func yLeftLineFind(it *image.Gray, ySeekCenter int, threshold uint8) (edgeX int) {
 	darkPxCount := 0
 	leftEdge := 0
-	rightEdge := 10
+	rightEdge := lineFindSpan
 	for y := ySeekCenter - 1; y < ySeekCenter+2; y++ {
 		for x := leftEdge; x < rightEdge; x++ {
-			if it.Y[(it.YStride*y)+x] < threshold {
+			if it.Pix[(it.Stride*y)+x] < threshold {
 				darkPxCount++
 			}
 		}
@@ -104,11 +103,11 @@ func yLeftLineFind(it *image.YCbCr, ySeekCenter int, threshold uint8) (edgeX int
 	for rightEdge < it.Rect.Max.X && darkPxCount < darkPxCountThreshold {
 		for y := ySeekCenter - 1; y < ySeekCenter+2; y++ {
 			x := leftEdge
-			if it.Y[(it.YStride*y)+x] < threshold {
+			if it.Pix[(it.Stride*y)+x] < threshold {
 				darkPxCount--
 			}
 			x = rightEdge
-			if it.Y[(it.YStride*y)+x] < threshold {
+			if it.Pix[(it.Stride*y)+x] < threshold {
 				darkPxCount++
 			}
 		}
@@ -118,13 +117,13 @@ func yLeftLineFind(it *image.YCbCr, ySeekCenter int, threshold uint8) (edgeX int
 	return rightEdge - 1
 }
 
-func yTopLineFind(it *image.YCbCr, xSeekCenter int, threshold uint8) (edgeY int) {
+func yTopLineFind(it *image.Gray, xSeekCenter int, threshold uint8) (edgeY int) {
 	darkPxCount := 0
 	topEdge := 0
-	bottomEdge := 10
+	bottomEdge := lineFindSpan
 	for y := topEdge; y < bottomEdge; y++ {
 		for x := xSeekCenter - 1; x < xSeekCenter+2; x++ {
-			if it.Y[(it.YStride*y)+x] < threshold {
+			if it.Pix[(it.Stride*y)+x] < threshold {
 				darkPxCount++
 			}
 		}
@@ -132,11 +131,11 @@ func yTopLineFind(it *image.YCbCr, xSeekCenter int, threshold uint8) (edgeY int)
 	for bottomEdge < it.Rect.Max.Y && darkPxCount < darkPxCountThreshold {
 		for x := xSeekCenter - 1; x < xSeekCenter+2; x++ {
 			y := topEdge
-			if it.Y[(it.YStride*y)+x] < threshold {
+			if it.Pix[(it.Stride*y)+x] < threshold {
 				darkPxCount--
 			}
 			y = bottomEdge
-			if it.Y[(it.YStride*y)+x] < threshold {
+			if it.Pix[(it.Stride*y)+x] < threshold {
 				darkPxCount++
 			}
 		}
@@ -146,6 +145,64 @@ func yTopLineFind(it *image.YCbCr, xSeekCenter int, threshold uint8) (edgeY int)
 	return bottomEdge - 1
 }
 
+// Search the luminance plane for a right edge, returns 0 if there isn't one
+func yRightLineFind(it *image.Gray, ySeekCenter int, threshold uint8) (edgeX int) {
+	darkPxCount := 0
+	leftEdge := it.Rect.Max.X - lineFindSpan
+	rightEdge := it.Rect.Max.X
+	for y := ySeekCenter - 1; y < ySeekCenter+2; y++ {
+		for x := leftEdge; x < rightEdge; x++ {
+			if it.Pix[(it.Stride*y)+x] < threshold {
+				darkPxCount++
+			}
+		}
+	}
+	for leftEdge > 0 && darkPxCount < darkPxCountThreshold {
+		for y := ySeekCenter - 1; y < ySeekCenter+2; y++ {
+			x := rightEdge - 1
+			if it.Pix[(it.Stride*y)+x] < threshold {
+				darkPxCount--
+			}
+			x = leftEdge - 1
+			if it.Pix[(it.Stride*y)+x] < threshold {
+				darkPxCount++
+			}
+		}
+		leftEdge--
+		rightEdge--
+	}
+	return leftEdge
+}
+
+// Search the luminance plane for a bottom edge, returns 0 if there isn't one
+func yBottomLineFind(it *image.Gray, xSeekCenter int, threshold uint8) (edgeY int) {
+	darkPxCount := 0
+	topEdge := it.Rect.Max.Y - lineFindSpan
+	bottomEdge := it.Rect.Max.Y
+	for y := topEdge; y < bottomEdge; y++ {
+		for x := xSeekCenter - 1; x < xSeekCenter+2; x++ {
+			if it.Pix[(it.Stride*y)+x] < threshold {
+				darkPxCount++
+			}
+		}
+	}
+	for topEdge > 0 && darkPxCount < darkPxCountThreshold {
+		for x := xSeekCenter - 1; x < xSeekCenter+2; x++ {
+			y := bottomEdge - 1
+			if it.Pix[(it.Stride*y)+x] < threshold {
+				darkPxCount--
+			}
+			y = topEdge - 1
+			if it.Pix[(it.Stride*y)+x] < threshold {
+				darkPxCount++
+			}
+		}
+		topEdge--
+		bottomEdge--
+	}
+	return topEdge
+}
+
 // https://en.wikipedia.org/wiki/Simple_linear_regression#Fitting_the_regression_line
 func ordinaryLeastSquares(points []point) (slope, intercept float64) {
 	xsum := int64(0)
@@ -194,6 +251,20 @@ type MatrixTransform struct {
 	mat []float64
 }
 
+// finiteMatrix is false for a missing or degenerate 3x3 transform
+func finiteMatrix(mat []float64) bool {
+	if len(mat) != 9 {
+		return false
+	}
+	for _, v := range mat {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return false
+		}
+	}
+	det := (mat[0] * ((mat[4] * mat[8]) - (mat[5] * mat[7]))) - (mat[1] * ((mat[3] * mat[8]) - (mat[5] * mat[6]))) + (mat[2] * ((mat[3] * mat[7]) - (mat[4] * mat[6])))
+	return math.Abs(det) > 1e-9
+}
+
 func (mt MatrixTransform) TransformInt(x, y int) (int, int) {
 	fx := float64(x)
 	fy := float64(y)
@@ -279,27 +350,54 @@ func (t transform) Transform(origx, origy float64) (x, y float64) {
 
 func colorY(c color.Color) uint8 {
 	r, g, b, a := c.RGBA()
-	sa := a >> 8
-	br := uint8(r / sa)
-	bg := uint8(g / sa)
-	bb := uint8(b / sa)
-	y, _, _ := color.RGBToYCbCr(br, bg, bb)
-	return y
+	return premulY(r, g, b, a)
 }
 
+// Scanner reads scanned ballot pages against a Template.
+// It holds the state of one scan at a time; use a Scanner per goroutine.
 type Scanner struct {
-	Bj BubblesJson
-
-	orig         image.Image
-	origPxPerPt  float64
-	origTopLeft  point
-	origTopRight point
-	origYThresh  uint8
+	t *Template
 
 	hist       []uint
 	scanThresh uint8
 
 	origToScanned AffineTransform
+	alignment     AlignmentQuality
+
+	// degrees clockwise the scan was turned to match the template
+	orientation int
+
+	// the hotspot debug image from the last refineTransform, for TargetsPngPath
+	targets *image.RGBA
+
+	// the global fit that localWarp replaced in origToScanned, nil if it didn't
+	globalFit AffineTransform
+
+	// index into Bj.Bubbles of the ballot style on the scanned sheet
+	style int
+
+	// FillBand sets which bubble fill fractions are ambiguous. A zero Low or High uses DefaultFillBand's.
+	FillBand FillBand
+
+	// SampleGrid sets how bubbles are sampled for measurement. Zero value uses DefaultSampleGrid.
+	SampleGrid SampleGrid
+
+	// AlignmentLimits rejects scans that don't fit the template well enough
+	AlignmentLimits AlignmentLimits
+
+	// Interpolator samples the scan between pixels. nil uses DefaultInterpolator.
+	Interpolator Interpolator
+
+	// Threshold picks how the scan is split into dark and light, for hotspot matching and bubble measurement alike.
+	// The zero value is ThresholdOtsu.
+	Threshold ThresholdMethod
+
+	// LocalWarp follows a curled or unevenly stretched sheet with a thin-plate spline through a dense grid of hotspots,
+	// found on the scan after the global fit has passed AlignmentLimits. Only for RegistrationBorder templates.
+	LocalWarp bool
+
+	// WholePixelHotspots leaves hotspot matches at the nearest whole pixel, skipping sub-pixel refinement
+	WholePixelHotspots bool
 
 	DebugOut io.Writer
 
@@ -308,76 +406,39 @@ type Scanner struct {
 	BubblesPngPath string
 }
 
-func (s *Scanner) debug(format string, args ...interface{}) {
-	if s.DebugOut != nil {
-		fmt.Fprintf(s.DebugOut, format, args...)
+func (s *Scanner) fillBand() FillBand {
+	band := s.FillBand
+	if band.Low <= 0 {
+		band.Low = DefaultFillBand.Low
 	}
-}
-
-func (s *Scanner) ReadBubblesJson(path string) error {
-	fin, err := os.Open(path)
-	if err != nil {
-		return err
+	if band.High <= 0 {
+		band.High = DefaultFillBand.High
 	}
-	defer fin.Close()
-	jd := json.NewDecoder(fin)
-	return jd.Decode(&s.Bj)
+	return band
 }
 
-func (s *Scanner) ReadOrigImage(origname string) error {
-	r, err := os.Open(origname)
-	maybeFail(err, "%s: %s", origname, err)
-	defer r.Close()
-	orig, format, err := image.Decode(r)
-	maybeFail(err, "%s: %v %s", origname, format, err)
-	return s.SetOrigImage(orig)
-}
-
-func (s *Scanner) SetOrigImage(orig image.Image) error {
-	s.orig = orig
-	orect := orig.Bounds()
-	if orect.Min.X != 0 || orect.Min.Y != 0 {
-		return fmt.Errorf("nonzero origin for original pic. WAT?\n")
-	}
-	s.debug("orig %T %v\n", orig, orect)
-	origPxPerPtX := float64(orect.Max.X-orect.Min.X) / s.Bj.DrawSettings.PageSize[0]
-	origPxPerPtY := float64(orect.Max.Y-orect.Min.Y) / s.Bj.DrawSettings.PageSize[1]
-	if math.Abs((origPxPerPtY/origPxPerPtX)-1) > 0.01 {
-		return fmt.Errorf("orig scale not square: mx = %f, my = %f\n", origPxPerPtX, origPxPerPtY)
-	}
-	s.origPxPerPt = (origPxPerPtX + origPxPerPtY) / 2.0
-	s.origTopLeft = point{
-		x: int(s.Bj.DrawSettings.PageMargin * s.origPxPerPt),
-		y: int(s.Bj.DrawSettings.PageMargin * s.origPxPerPt),
-	}
-	s.origTopRight = point{
-		x: int((s.Bj.DrawSettings.PageSize[0] - s.Bj.DrawSettings.PageMargin) * s.origPxPerPt),
-		y: int(s.Bj.DrawSettings.PageMargin * s.origPxPerPt),
+func (s *Scanner) debug(format string, args ...interface{}) {
+	if s.DebugOut != nil {
+		fmt.Fprintf(s.DebugOut, format, args...)
 	}
-	s.debug("top line orig (%d,%d)-(%d,%d)\n", s.origTopLeft.x, s.origTopLeft.y, s.origTopRight.x, s.origTopRight.y)
+}
 
-	var hist [256]uint
-	for iy := orect.Min.Y; iy < orect.Max.Y; iy++ {
-		for ix := orect.Min.X; ix < orect.Max.X; ix++ {
-			y := colorY(orig.At(ix, iy))
-			hist[y]++
-		}
-	}
-	s.origYThresh = otsuThreshold(hist[:])
-	return nil
+// NewScanner makes a Scanner for pages printed from t
+func NewScanner(t *Template) *Scanner {
+	return &Scanner{t: t}
 }
 
-func (s *Scanner) DebugOrigBubbles(outpath string) error {
+func (t *Template) DebugOrigBubbles(outpath string) error {
 	imout, err := os.Create(outpath)
 	if err != nil {
-		return fmt.Errorf("%s: could not create, %v", outpath, err)
+		return newError(ReasonDebugOutput, err, "%s: could not create", outpath)
 	}
 	defer imout.Close()
 
 	sourceSelectionBounds := make([][]float64, 0, 100)
 	maxWidth := 0.0
 	maxHeight := 0.0
-	for _, ballotType := range s.Bj.Bubbles {
+	for _, ballotType := range t.bj.Bubbles {
 		for _, csels := range ballotType { // _ = contestName
 			for _, xywh := range csels { // _ = cselName
 				sourceSelectionBounds = append(sourceSelectionBounds, xywh)
@@ -386,30 +447,30 @@ func (s *Scanner) DebugOrigBubbles(outpath string) error {
 			}
 		}
 	}
-	maxWidth = math.Ceil(maxWidth * s.origPxPerPt)
-	maxHeight = math.Ceil(maxHeight * s.origPxPerPt)
+	maxWidth = math.Ceil(maxWidth * t.pxPerPt)
+	maxHeight = math.Ceil(maxHeight * t.pxPerPt)
 	oiw := int(maxWidth) * 4
 	oih := int(maxHeight) * 4 * len(sourceSelectionBounds)
 	orect := image.Rect(0, 0, oiw, oih)
 	oi := image.NewNRGBA(orect)
-	opngBounds := s.orig.Bounds()
+	opngBounds := t.orig.Bounds()
 	for i, xywh := range sourceSelectionBounds {
 		// (printx,printy) coord in pt from bottom left
 		printx := xywh[0]
 		printy := xywh[1]
 		// coords in orig png, bottom left pixel
-		opngx := printx * s.origPxPerPt
-		opngy := float64(opngBounds.Max.Y) - (printy * s.origPxPerPt)
+		opngx := printx * t.pxPerPt
+		opngy := float64(opngBounds.Max.Y) - (printy * t.pxPerPt)
 
 		outy := (int(maxHeight) * 4 * (i + 1)) - 1
-		outWidthPx := int(math.Ceil(xywh[2] * 4 * s.origPxPerPt))
-		outHeightPx := int(math.Ceil(xywh[3] * 4 * s.origPxPerPt))
+		outWidthPx := int(math.Ceil(xywh[2] * 4 * t.pxPerPt))
+		outHeightPx := int(math.Ceil(xywh[3] * 4 * t.pxPerPt))
 		for iy := 0; iy < outHeightPx; iy++ {
 			dy := opngy - (float64(iy) * 0.25)
 			for ix := 0; ix < outWidthPx; ix++ {
 				pi := ((outy - iy) * oi.Stride) + (ix * 4)
 				dx := opngx + (float64(ix) * 0.25)
-				oc := ImageBiCatrom(s.orig, dx, dy)
+				oc := ImageBiCatrom(t.orig, dx, dy)
 				oi.Pix[pi] = oc.R
 				oi.Pix[pi+1] = oc.G
 				oi.Pix[pi+2] = oc.B
@@ -423,132 +484,27 @@ func (s *Scanner) DebugOrigBubbles(outpath string) error {
 
 const hotspotSize = 15
 
-// check potential hotspot center (tx,ty) for quality
-func (s *Scanner) origImageHotspotsQuality(tx, ty int, scratch []uint8) int {
-	// scratch should be [hotspotSize*hotspotSize]bool
-
-	mx := tx - (hotspotSize / 2)
-	my := ty - (hotspotSize / 2)
-	for iy := 0; iy < hotspotSize; iy++ {
-		for ix := 0; ix < hotspotSize; ix++ {
-			y := colorY(s.orig.At(mx+ix, my+iy))
-			if y >= s.origYThresh {
-				scratch[(hotspotSize*iy)+ix] = 1
-			} else {
-				scratch[(hotspotSize*iy)+ix] = 0
-			}
-		}
-	}
-	dx := 0
-	for iy := 0; iy < hotspotSize; iy++ {
-		yo := iy * hotspotSize
-		for ix := 0; ix < hotspotSize-6; ix++ {
-			if (scratch[yo+ix] == scratch[yo+ix+1]) && (scratch[yo+ix] == scratch[yo+ix+2]) && (scratch[yo+ix] != scratch[yo+ix+3]) && (scratch[yo+ix] != scratch[yo+ix+4]) && (scratch[yo+ix] != scratch[yo+ix+5]) {
-				dx++
-			}
-		}
-	}
-	dy := 0
-	for iy := 0; iy < hotspotSize-6; iy++ {
-		y0 := iy * hotspotSize
-		y1 := (iy + 1) * hotspotSize
-		y2 := (iy + 2) * hotspotSize
-		y3 := (iy + 3) * hotspotSize
-		y4 := (iy + 4) * hotspotSize
-		y5 := (iy + 5) * hotspotSize
-		for ix := 0; ix < hotspotSize; ix++ {
-			if (scratch[y0+ix] == scratch[y1+ix]) && (scratch[y0+ix] == scratch[y2+ix]) && (scratch[y0+ix] != scratch[y3+ix]) && (scratch[y0+ix] != scratch[y4+ix]) && (scratch[y0+ix] != scratch[y5+ix]) {
-				dy++
-			}
-		}
-	}
-	fx := float64(dx)
-	fx = (math.Log10(fx*0.5) + 0.5) * fx
-	fy := float64(dy)
-	fy = (math.Log10(fy*0.5) + 0.5) * fy
-	return int(fx + fy)
-}
-
-const nHotspots = 20
-
-// returns hotspot center points [](x,y)
-func (s *Scanner) findOrigImageHotspots() []point {
-	// find ~20 spots 16x16 px with dx feature and dy feature
-	orect := s.orig.Bounds()
-
-	width := orect.Max.X - orect.Min.X
-	height := orect.Max.Y - orect.Min.Y
-
-	spots := make([]point, 0, nHotspots)
-	//scores := make([]int, 0, nHotspots)
-	//scratch := make([]uint8, hotspotSize*hotspotSize)
-	var scores [nHotspots]int
-	var scratch [hotspotSize * hotspotSize]uint8
-	// check 5x what we want, keep the best
-	checkCount := 0
-	for checkCount < nHotspots*5 {
-		tx := rand.Intn(width-(2*hotspotSize)) + hotspotSize
-		ty := rand.Intn(height-(2*hotspotSize)) + hotspotSize
-		score := s.origImageHotspotsQuality(tx, ty, scratch[:])
-		if score < 0 {
-			continue
-		}
-		if len(spots) == 0 {
-			spots = append(spots, point{tx, ty})
-			//scores = append(scores, score)
-			scores[0] = score
-			continue
-		}
-		pos := len(spots) - 1
-		for score > scores[pos] {
-			// insertion sort
-			if pos < nHotspots {
-				if (pos + 1) < len(spots) {
-					scores[pos+1] = scores[pos]
-					spots[pos+1] = spots[pos]
-				} else if (pos + 1) < nHotspots {
-					//scores = append(scores, scores[pos])
-					scores[pos+1] = scores[pos]
-					spots = append(spots, spots[pos])
-				}
-			}
-			spots[pos].x = tx
-			spots[pos].y = ty
-			scores[pos] = score
-			if pos == 0 {
-				break
-			}
-			pos--
-		}
-		if pos == (len(spots)-1) && (pos+1) < nHotspots {
-			//scores = append(scores, scores[pos])
-			scores[pos+1] = score
-			spots = append(spots, point{tx, ty})
-		}
-		checkCount++
-	}
-	return spots
-}
+// a hotspot must not look like the page around it within +/- seekSize/2 template pixels
+const seekSize = hotspotSize * 3
 
 // copy source data in hotspots to image so we can see what targets we're picking
-func (s *Scanner) hotspotsDebugImage(spots []point, it *image.YCbCr) *image.RGBA {
+func (s *Scanner) hotspotsDebugImage(spots []hotspot, it *image.Gray) *image.RGBA {
 	width := hotspotSize * 6
 	height := hotspotSize * len(spots)
 	s.debug("hots %dx%d\n", width, height)
 	outrect := image.Rect(0, 0, width, height)
 	out := image.NewRGBA(outrect)
 	for i, spt := range spots {
-		mx := spt.x - (hotspotSize / 2)
-		my := spt.y - (hotspotSize / 2)
+		mx := spt.center.x - (hotspotSize / 2)
+		my := spt.center.y - (hotspotSize / 2)
 		for iy := 0; iy < hotspotSize; iy++ {
 			for ix := 0; ix < hotspotSize; ix++ {
-				sc := s.orig.At(mx+ix, my+iy)
+				sc := s.t.orig.At(mx+ix, my+iy)
 				out.Set(ix, iy+(i*hotspotSize), sc)
 
 				if it != nil {
 					sx, sy := s.origToScanned.Transform(float64(mx+ix), float64(my+iy))
-					sc = ImageBiCatrom(it, sx, sy)
-					out.Set(ix+hotspotSize, iy+(i*hotspotSize), sc)
+					out.Set(ix+hotspotSize, iy+(i*hotspotSize), color.Gray{s.sample(it, sx, sy)})
 				}
 			}
 		}
@@ -556,26 +512,29 @@ func (s *Scanner) hotspotsDebugImage(spots []point, it *image.YCbCr) *image.RGBA
 	return out
 }
 
-func (s *Scanner) ReadScannedImage(fname string) (marked map[string]map[string]bool, err error) {
+func (s *Scanner) ReadScannedImage(fname string) (result *ScanResult, err error) {
 	r, err := os.Open(fname)
 	if err != nil {
-		return nil, err
+		return nil, newError(ReasonImageRead, err, "%s", fname)
 	}
 	defer r.Close()
-	im, _, err := image.Decode(r)
+	im, format, err := image.Decode(r)
 	if err != nil {
-		return nil, err
+		return nil, newError(ReasonUnsupportedImage, err, "%s: %v", fname, format)
 	}
 	return s.ProcessScannedImage(im)
 }
 
-func (s *Scanner) ProcessScannedImage(im image.Image) (marked map[string]map[string]bool, err error) {
-	switch it := im.(type) {
-	case *image.YCbCr:
-		return s.processYCbCr(it)
-	default:
-		return nil, fmt.Errorf("unknown image type %T", im)
+// ProcessScannedImage finds marked bubbles in a scanned image of any image.Image type.
+func (s *Scanner) ProcessScannedImage(im image.Image) (result *ScanResult, err error) {
+	if im.Bounds().Empty() {
+		return nil, newError(ReasonUnsupportedImage, nil, "empty image %T %v", im, im.Bounds())
+	}
+	lp := lumaPlane(im)
+	if s.t.dropout != nil {
+		s.t.dropout.apply(im, lp)
 	}
+	return s.processLuma(lp)
 }
 
 func fmax(a, b float64) float64 {
@@ -585,8 +544,14 @@ func fmax(a, b float64) float64 {
 	return b
 }
 
+// A border sloped more than this from its side of the scan is not a border, about 11 degrees
+const maxTopLineSlope = 0.2
+
 // find the top border and calculate an initial transform based on it
-func (s *Scanner) topLineYCbCr(it *image.YCbCr) error {
+func (s *Scanner) topLine(it *image.Gray) error {
+	if err := lineFindable(it); err != nil {
+		return err
+	}
 	misscount := 0
 	hitcount := 0
 	topPoints := make([]point, 0, 100)
@@ -600,8 +565,17 @@ func (s *Scanner) topLineYCbCr(it *image.YCbCr) error {
 			misscount++
 		}
 	}
+	if len(topPoints) < 2 {
+		return newError(ReasonNoTopBorder, nil, "no top line found, %d hit %d miss", hitcount, misscount)
+	}
+	if hitcount < misscount {
+		return newError(ReasonNoTopBorder, nil, "top line mostly missing, %d hit %d miss", hitcount, misscount)
+	}
 	slope, intercept := ordinaryLeastSquares(topPoints)
 	s.debug("top line %d hit %d miss, slope=%f intercept=%f\n", hitcount, misscount, slope, intercept)
+	if math.Abs(slope) > maxTopLineSlope {
+		return newError(ReasonNoTopBorder, nil, "top line too steep, slope=%f", slope)
+	}
 	worstd := 0.0
 	for _, pt := range topPoints {
 		d := pointLineDistance(slope, intercept, pt.x, pt.y)
@@ -609,43 +583,38 @@ func (s *Scanner) topLineYCbCr(it *image.YCbCr) error {
 			worstd = d
 		}
 	}
-	x := topPoints[0].x
-	y := topPoints[0].y
-	const step = 5
-	for true {
-		nx := x - step
-		yte := yTopLineFind(it, nx, s.scanThresh)
-		d := pointLineDistance(slope, intercept, nx, yte)
-		if d > worstd {
-			break
+	// integer edge positions wobble by a pixel or so even on a perfect line
+	worstd = fmax(worstd, 1.5)
+	// walk out along the line from an end point until it stops, coarse then fine
+	extend := func(x, y, dir int) point {
+		for _, step := range []int{5, 1} {
+			for x+(dir*step) > 0 && x+(dir*step) < it.Rect.Max.X-1 {
+				nx := x + (dir * step)
+				yte := yTopLineFind(it, nx, s.scanThresh)
+				d := pointLineDistance(slope, intercept, nx, yte)
+				if d > worstd {
+					break
+				}
+				x = nx
+				y = yte
+			}
 		}
-		x = nx
-		y = yte
+		return point{x, y}
 	}
-	topLeft := point{x, y}
+	topLeft := extend(topPoints[0].x, topPoints[0].y, -1)
 	last := len(topPoints) - 1
-	x = topPoints[last].x
-	y = topPoints[last].y
-	for true {
-		nx := x + step
-		yte := yTopLineFind(it, nx, s.scanThresh)
-		d := pointLineDistance(slope, intercept, nx, yte)
-		if d > worstd {
-			break
-		}
-		x = nx
-		y = yte
-	}
-	topRight := point{x, y}
+	topRight := extend(topPoints[last].x, topPoints[last].y, 1)
 	s.debug("topleft (%d,%d) topright (%d,%d)\n", topLeft.x, topLeft.y, topRight.x, topRight.y)
+	if topRight.x-topLeft.x < it.Rect.Max.X/2 {
+		return newError(ReasonNoTopBorder, nil, "top line only %d px of %d px wide scan", topRight.x-topLeft.x, it.Rect.Max.X)
+	}
 
-	s.origToScanned = newTransform(s.origTopLeft, s.origTopRight, topLeft, topRight)
-	// TODO: detect if we failed to detect a reasonable top line and return error
+	s.origToScanned = newTransform(s.t.topLeft, s.t.topRight, topLeft, topRight)
 	return nil
 }
 
-func (s *Scanner) refineTransform(it *image.YCbCr) error {
-	spots := s.findOrigImageHotspots()
+func (s *Scanner) refineTransform(it *image.Gray) error {
+	spots := s.t.hotspots
 	var debugi *image.RGBA
 	if s.TargetsPngPath != "" {
 		debugi = s.hotspotsDebugImage(spots, it)
@@ -653,73 +622,24 @@ func (s *Scanner) refineTransform(it *image.YCbCr) error {
 
 	sources := make([]FPoint, len(spots))
 	dests := make([]FPoint, len(spots))
-
-	var scratch [hotspotSize * hotspotSize]uint8
-	for spoti, spot := range spots {
-		// copy thresholded orig to scratch
-		mx := spot.x - (hotspotSize / 2)
-		my := spot.y - (hotspotSize / 2)
-		for iy := 0; iy < hotspotSize; iy++ {
-			for ix := 0; ix < hotspotSize; ix++ {
-				sc := s.orig.At(mx+ix, my+iy)
-				y := colorY(sc)
-				if y >= s.origYThresh {
-					scratch[(hotspotSize*iy)+ix] = 1
-				} else {
-					scratch[(hotspotSize*iy)+ix] = 0
-				}
-				if debugi != nil {
+	scanLevels := grayPyramid(it, pyramidLevels)
+
+	s.alignment = AlignmentQuality{Hotspots: make([]HotspotMatch, len(spots))}
+	for spoti := range spots {
+		spot := &spots[spoti]
+		scratch := &spot.patch
+		mx := spot.center.x - (hotspotSize / 2)
+		my := spot.center.y - (hotspotSize / 2)
+		if debugi != nil {
+			for iy := 0; iy < hotspotSize; iy++ {
+				for ix := 0; ix < hotspotSize; ix++ {
 					debugi.Set(ix+(hotspotSize*4), iy+(hotspotSize*spoti), color.Gray{scratch[(hotspotSize*iy)+ix] * 255})
 				}
 			}
 		}
-		bestdx := hotspotSize
-		bestdy := hotspotSize
-		bestssd := hotspotSize * hotspotSize
-		// seek match
-		const seekSize = hotspotSize * 3
-		for dyi := 0; dyi < seekSize; dyi++ {
-			dy := dyi - (seekSize / 2)
-			//for dy := hotspotSize / -2; dy < hotspotSize/2; dy++ {
-			for dxi := 0; dxi < seekSize; dxi++ {
-				dx := dxi - (seekSize / 2)
-				//for dx := hotspotSize / -2; dx < hotspotSize/2; dx++ {
-				ssd := 0
-				// compare spot, offset by (dx,dy)
-				for iy := 0; iy < hotspotSize; iy++ {
-					y := my + dy + iy
-					for ix := 0; ix < hotspotSize; ix++ {
-						x := mx + dx + ix
-						sx, sy := s.origToScanned.Transform(float64(x), float64(y))
-						syv := YBiCatrom(it, sx, sy)
-						var stv uint8
-						if syv > s.scanThresh {
-							stv = 1
-						} else {
-							stv = 0
-						}
-						if stv != scratch[(hotspotSize*iy)+ix] {
-							//s.debug(" %d,%d", x, y)
-							ssd++
-						}
-					}
-				}
-				//fmt.Print("\n")
-				if debugi != nil {
-					debugi.Set(dxi+(hotspotSize*2), dyi+(hotspotSize*spoti), color.Gray{uint8(ssd)})
-				}
-				if ssd < bestssd {
-					//s.debug("(%d,%d) %d -> (%d,%d) %d\n", bestdx, bestdy, bestssd, dx, dy, ssd)
-					bestdx = dx
-					bestdy = dy
-					bestssd = ssd
-				} else {
-					//s.debug("(%d,%d) %d\n", dx, dy, ssd)
-				}
-			}
-		}
+		bestdx, bestdy, bestssd := s.matchHotspot(spot, scanLevels)
 		if bestdx != 0 || bestdy != 0 {
-			s.debug("refine transform %d,%d -> %d,%d (%d, %d)\n", spot.x, spot.y, spot.x+bestdx, spot.y+bestdy, bestdx, bestdy)
+			s.debug("refine transform %d,%d -> %d,%d (%d, %d)\n", spot.center.x, spot.center.y, spot.center.x+bestdx, spot.center.y+bestdy, bestdx, bestdy)
 		} else {
 			s.debug("refine transform no change\n")
 		}
@@ -729,32 +649,72 @@ func (s *Scanner) refineTransform(it *image.YCbCr) error {
 				for ix := 0; ix < hotspotSize; ix++ {
 					x := mx + bestdx + ix
 					sx, sy := s.origToScanned.Transform(float64(x), float64(y))
-					syv := YBiCatrom(it, sx, sy)
+					syv := s.sample(it, sx, sy)
 					debugi.Set(ix+(hotspotSize*3), iy+(hotspotSize*spoti), color.Gray{syv})
 					//sc := ImageBiCatrom(it, sx, sy)
 					//debugi.Set(ix+(hotspotSize*3), iy+(hotspotSize*spoti), sc)
 				}
 			}
 		}
-		sources[spoti].SetInt(spot.x, spot.y)
-		dests[spoti].X, dests[spoti].Y = s.origToScanned.Transform(float64(spot.x+bestdx), float64(spot.y+bestdy))
-		// TODO: subpixel refinement
+		matchError := float64(bestssd) / float64(hotspotSize*hotspotSize)
+		s.alignment.MeanMatchError += matchError
+		s.alignment.WorstMatchError = fmax(s.alignment.WorstMatchError, matchError)
+		var subdx, subdy float64
+		if !s.WholePixelHotspots {
+			subdx, subdy = s.subpixelOffset(it, spot, bestdx, bestdy)
+		}
+		sources[spoti].SetInt(spot.center.x, spot.center.y)
+		dests[spoti].X, dests[spoti].Y = s.origToScanned.Transform(float64(spot.center.x+bestdx)+subdx, float64(spot.center.y+bestdy)+subdy)
+		s.alignment.Hotspots[spoti] = HotspotMatch{
+			X:          sources[spoti].X,
+			Y:          sources[spoti].Y,
+			ScanX:      dests[spoti].X,
+			ScanY:      dests[spoti].Y,
+			MatchError: matchError,
+		}
+	}
+	if len(spots) < 3 {
+		return newError(ReasonAlignmentDiverged, nil, "only %d template hotspots", len(spots))
 	}
-	fmat := FindTransform(sources, dests)
+	s.alignment.MeanMatchError /= float64(len(spots))
+	fmat, inliers := FindTransformRansac(sources, dests, s.AlignmentLimits.orDefault().MaxInlierResidual)
 	s.debug("transform %v\n", fmat)
+	if !finiteMatrix(fmat) {
+		return newError(ReasonAlignmentDiverged, nil, "hotspot fit gave transform %v", fmat)
+	}
+	for i, inlier := range inliers {
+		if !inlier {
+			s.debug("hotspot %d,%d outlier\n", spots[i].center.x, spots[i].center.y)
+			s.alignment.Hotspots[i].Outlier = true
+		}
+	}
 	s.origToScanned = &MatrixTransform{fmat}
-	if s.TargetsPngPath != "" {
-		imout, err := os.Create(s.TargetsPngPath)
-		maybeFail(err, "%s: %s\n", s.TargetsPngPath, err)
-		defer imout.Close()
-		err = png.Encode(imout, debugi)
-		maybeFail(err, "%s: %s\n", s.TargetsPngPath, err)
+	orect := s.t.orig.Rect
+	s.alignment.measureFit(s.origToScanned, float64(orect.Max.X)/2, float64(orect.Max.Y)/2)
+	s.debug("%d/%d inliers, reprojection rms %f max %f, scale (%f,%f) skew %f\n", s.alignment.Inliers, len(spots), s.alignment.ReprojectionRMS, s.alignment.ReprojectionMax, s.alignment.ScaleX, s.alignment.ScaleY, s.alignment.Skew)
+	s.targets = debugi
+	return nil
+}
+
+// writeTargets writes the hotspot debug image for the chosen orientation to TargetsPngPath, if there is one
+func (s *Scanner) writeTargets() error {
+	if s.TargetsPngPath == "" || s.targets == nil {
+		return nil
+	}
+	imout, err := os.Create(s.TargetsPngPath)
+	if err != nil {
+		return newError(ReasonDebugOutput, err, "%s", s.TargetsPngPath)
+	}
+	defer imout.Close()
+	err = png.Encode(imout, s.targets)
+	if err != nil {
+		return newError(ReasonDebugOutput, err, "%s", s.TargetsPngPath)
 	}
 	return nil
 }
 
-func (s *Scanner) translateWholeScanToOrig(it *image.YCbCr) (dboi image.Image, err error) {
-	orect := s.orig.Bounds()
+func (s *Scanner) translateWholeScanToOrig(it *image.Gray) (dboi image.Image, err error) {
+	orect := s.t.orig.Rect
 	oi := image.NewNRGBA(orect)
 	for iy := orect.Min.Y; iy < orect.Max.Y; iy++ {
 		// zero based coord
@@ -765,7 +725,7 @@ func (s *Scanner) translateWholeScanToOrig(it *image.YCbCr) (dboi image.Image, e
 			pi := (zy * oi.Stride) + (zx * 4)
 			if true {
 				sx, sy := s.origToScanned.Transform(float64(zx), float64(zy))
-				yv := YBiCatrom(it, sx, sy)
+				yv := s.sample(it, sx, sy)
 				oi.Set(zx, zy, color.Gray{yv})
 			} else if true {
 				sx, sy := s.origToScanned.Transform(float64(zx), float64(zy))
@@ -776,7 +736,7 @@ func (s *Scanner) translateWholeScanToOrig(it *image.YCbCr) (dboi image.Image, e
 				oi.Pix[pi+3] = oc.A
 			} else {
 				sx, sy := s.origToScanned.TransformInt(zx, zy)
-				v := it.Y[(sy*it.YStride)+sx]
+				v := it.Pix[(sy*it.Stride)+sx]
 				oi.Pix[pi] = v      // R
 				oi.Pix[pi+1] = v    // G
 				oi.Pix[pi+2] = v    // B
@@ -787,20 +747,8 @@ func (s *Scanner) translateWholeScanToOrig(it *image.YCbCr) (dboi image.Image, e
 	return oi, nil
 }
 
-func (s *Scanner) processYCbCr(it *image.YCbCr) (marked map[string]map[string]bool, err error) {
-	if it.Rect.Min.X != 0 || it.Rect.Min.Y != 0 {
-		return nil, fmt.Errorf("image origin not 0,0 but %d,%d", it.Rect.Min.X, it.Rect.Min.Y)
-	}
-	s.debug("it YStride %d CStride %d SubsampleRatio %v Rect %v\n", it.YStride, it.CStride, it.SubsampleRatio, it.Rect)
-	// pxy(it, 0, 0)
-	// pxy(it, 1, 0)
-	// pxy(it, 2, 0)
-	// pxy(it, 0, 1)
-	// pxy(it, 0, 2)
-	// pxy(it, 50, 50)
-	// pxy(it, it.Rect.Max.X-1, it.Rect.Max.Y-1)
-	//s.debug("(50,50) Y=%d, (50,50) CrCb=%d\n", it.COffset(50, 50), it.YOffset(50, 50))
-	//s.debug("(%d,%d) Y=%d, (%d,%d) CrCb=%d\n", it.Rect.Max.X-1, it.Rect.Max.Y-1, it.COffset(it.Rect.Max.X-1, it.Rect.Max.Y-1), it.Rect.Max.X-1, it.Rect.Max.Y-1, it.YOffset(it.Rect.Max.X-1, it.Rect.Max.Y-1))
+func (s *Scanner) processLuma(it *image.Gray) (result *ScanResult, err error) {
+	s.debug("it Stride %d Rect %v\n", it.Stride, it.Rect)
 
 	s.hist = yHistogram(it)
 	s.scanThresh = otsuThreshold(s.hist)
@@ -810,24 +758,33 @@ func (s *Scanner) processYCbCr(it *image.YCbCr) (marked map[string]map[string]bo
 			s.debug("hist[%3d] %6d\n", i, v)
 		}
 	}
-	misscount := 0
-	hitcount := 0
-	for y := 100; y < it.Rect.Max.Y-100; y += 50 {
-		xle := yLeftLineFind(it, y, s.scanThresh)
-		if xle < it.Rect.Max.X/2 {
-			//s.debug("[%d,%d]\n", xle, y)
-			hitcount++
-		} else {
-			misscount++
-		}
+	// flat is what dark and light are told apart on, it itself unless adaptive thresholding flattens a copy.
+	// The barcode and the images people look at come from it.
+	flat := it
+	if s.Threshold == ThresholdSauvola || s.Threshold == ThresholdNiblack {
+		flat = adaptiveFlatten(it, s.Threshold)
+		s.scanThresh = flatThreshold
 	}
-	s.debug("left line %d hit %d miss\n", hitcount, misscount)
-
-	err = s.topLineYCbCr(it)
+	upright, err := s.orient(flat)
+	if err != nil {
+		return nil, err
+	}
+	if flat == it {
+		it = upright
+	} else {
+		it = rotateGray(it, s.orientation/90)
+	}
+	flat = upright
+	err = s.alignment.check(s.AlignmentLimits)
 	if err != nil {
+		s.debug("%v\n", err)
 		return nil, err
 	}
-	s.refineTransform(it)
+	globalFit := s.origToScanned
+	s.globalFit = nil
+	if s.LocalWarp && s.t.warpHotspots != nil {
+		s.localWarp(flat)
+	}
 	if s.DebugPngPath != "" {
 		dbimg, err := s.translateWholeScanToOrig(it)
 		if err != nil {
@@ -835,200 +792,221 @@ func (s *Scanner) processYCbCr(it *image.YCbCr) (marked map[string]map[string]bo
 		}
 		dbfout, err := os.Create(s.DebugPngPath)
 		if err != nil {
-			return nil, err
+			return nil, newError(ReasonDebugOutput, err, "%s", s.DebugPngPath)
 		}
 		err = png.Encode(dbfout, dbimg)
+		dbfout.Close()
 		if err != nil {
-			return nil, err
+			return nil, newError(ReasonDebugOutput, err, "%s", s.DebugPngPath)
+		}
+	}
+	barcode := s.readBarcode(it)
+	var styleScores []float64
+	s.style, styleScores = s.identifyStyle(flat)
+	outlineStyle := s.style
+	if barcode != nil && barcode.Style >= 0 {
+		if barcode.Style < len(s.t.styles) {
+			s.debug("style %d from barcode\n", barcode.Style)
+			s.style = barcode.Style
+		} else {
+			s.debug("barcode style %d but only %d styles\n", barcode.Style, len(s.t.styles))
 		}
 	}
 	if s.BubblesPngPath != "" {
-		err = s.debugScannedBubbles(it)
+		err = s.debugScannedBubbles(it, flat)
 		if err != nil {
 			return nil, err
 		}
 	}
-	return s.measureScannedBubbles(it), nil
+	result = s.measureScannedBubbles(it, flat)
+	result.Style = s.style
+	result.StyleScores = styleScores
+	result.Barcode = barcode
+	if styleScores != nil && s.style != outlineStyle {
+		// the barcode says one style and the printed bubbles another
+		s.debug("barcode style %d but outlines say style %d, needs review\n", s.style, outlineStyle)
+		result.flagReview(ReviewStyleMismatch, "", "")
+	} else if barcode != nil && barcode.Style >= len(s.t.styles) {
+		result.flagReview(ReviewUnknownStyle, "", "")
+	} else if styleScores != nil && styleScores[s.style] < minStyleScore {
+		s.debug("best style %d only scored %f, needs review\n", s.style, styleScores[s.style])
+		result.flagReview(ReviewUnknownStyle, "", "")
+	}
+	if mt, ok := globalFit.(*MatrixTransform); ok {
+		result.Transform = mt.mat
+	}
+	result.Alignment = s.alignment
+	result.Orientation = s.orientation
+	return result, nil
 }
 
-func (s *Scanner) measureBubble(it *image.YCbCr, xywh []float64) (darkCount, pxCount int) {
-	darkCount = 0
-	pxCount = 0
-	// (printx,printy) coord in pt from bottom left
-	printx := xywh[0]
-	printy := xywh[1]
-	// coords in orig png, bottom left pixel
-	opngBounds := s.orig.Bounds()
-	opngx := printx * s.origPxPerPt
-	opngy := float64(opngBounds.Max.Y) - (printy * s.origPxPerPt)
-
-	//outy := (int(maxHeight) * 4 * (i + 1)) - 1
-	outWidthPx := int(math.Ceil(xywh[2] * 4 * s.origPxPerPt))
-	outHeightPx := int(math.Ceil(xywh[3] * 4 * s.origPxPerPt))
-	centerY := outHeightPx / 2
-	minsamplex := outWidthPx / 10
-	maxsamplex := (outWidthPx * 9) / 10
-	for iiy := -1; iiy <= 1; iiy++ {
-		iy := centerY + (iiy * 8)
-		//for iy := 0; iy < outHeightPx; iy++ {
-		dy := opngy - (float64(iy) * 0.25)
-		for ix := minsamplex; ix < maxsamplex; ix += 16 {
-			//for ix := 0; ix < outWidthPx; ix++ {
-			dx := opngx + (float64(ix) * 0.25)
-			sx, sy := s.origToScanned.Transform(dx, dy)
-			oc := ImageBiCatrom(it, sx, sy)
-			//if (iy == centerY || iy == (centerY-8) || iy == (centerY+8)) && (ix%16 == 0) && (ix > minsamplex) && (ix < maxsamplex) {
-			oc.G = 255
-			oc.R /= 2
-			oc.B /= 2
-			syv := YBiCatrom(it, sx, sy)
-			if syv < s.scanThresh {
-				darkCount++
-			}
-			pxCount++
-			//}
-			/*
-				if oi != nil {
-					pi := ((outy - iy) * oi.Stride) + (ix * 4)
-					oi.Pix[pi] = oc.R
-					oi.Pix[pi+1] = oc.G
-					oi.Pix[pi+2] = oc.B
-					oi.Pix[pi+3] = oc.A
-				}
-			*/
-		}
+// inkMargin is how far from printed ink, in template pixels, samples in r are left out:
+// printedMargin, and as far again as the local warp moved r from the global fit.
+// The warp follows hotspots found a pixel or so off on a flattened scan, and that shift is no voter's mark.
+func (s *Scanner) inkMargin(r pxRect) int {
+	if s.globalFit == nil {
+		return printedMargin
 	}
-	// TODO: record mediocre matches with 30%-70% fill, flag for inspection
-	// TODO: measure extraneous marks in ballot and flag for review
-	return
-	/*
-		s.debug("%d/%d dark/all px\n", darkCount, pxCount)
-		if darkCount > ((pxCount * 7) / 10) {
-		}
-	*/
+	cx := r.x + (r.w / 2)
+	cy := r.y + (r.h / 2)
+	wx, wy := s.origToScanned.Transform(cx, cy)
+	gx, gy := s.globalFit.Transform(cx, cy)
+	shift := math.Hypot(wx-gx, wy-gy)
+	if scale := (s.alignment.ScaleX + s.alignment.ScaleY) / 2; scale > 0 {
+		// scan pixels to template pixels
+		shift /= scale
+	}
+	return printedMargin + int(math.Ceil(shift))
 }
 
-func (s *Scanner) measureScannedBubbles(it *image.YCbCr) (marked map[string]map[string]bool) {
-	marked = make(map[string]map[string]bool)
-	for _, ballotType := range s.Bj.Bubbles {
-		for contestName, csels := range ballotType {
-			conout := make(map[string]bool)
-			for cselName, xywh := range csels {
-				darkCount, pxCount := s.measureBubble(it, xywh)
-				s.debug("%s\t%s\t%d/%d dark/all px\n", contestName, cselName, darkCount, pxCount)
-				if darkCount > ((pxCount * 7) / 10) {
-					conout[cselName] = true
-				}
-			}
-			marked[contestName] = conout
+// A bubble with less than this fraction of its area clear of printed ink can't be measured
+const minSampleableArea = 0.25
+
+// measureBubble samples the bubble tb on the scan over the Scanner's SampleGrid,
+// leaving out samples on the bubble's own printing. Too little left makes it Unreadable.
+// each, if not nil, is called with every sample counted, in template pixels.
+func (s *Scanner) measureBubble(it *image.Gray, tb *templateBubble, each func(x, y float64, dark bool)) *BubbleResult {
+	br := &BubbleResult{}
+	total := 0.0
+	margin := s.inkMargin(tb.rect)
+	s.sampleGrid().cells(tb.rect, s.t.pxPerPt, func(x, y, area float64) {
+		total += area
+		if s.t.bubbleInk(tb, x, y, margin) {
+			// the bubble's own ink, dark on every scan
+			return
+		}
+		sx, sy := s.origToScanned.Transform(x, y)
+		dark := s.sample(it, sx, sy) < s.scanThresh
+		if dark {
+			br.DarkCount++
+			br.DarkArea += area
 		}
+		br.PxCount++
+		br.Area += area
+		if each != nil {
+			each(x, y, dark)
+		}
+	})
+	// TODO: measure extraneous marks in ballot and flag for review
+	br.classify(s.fillBand())
+	if br.Area < minSampleableArea*total {
+		br.Unreadable = true
+		br.Mark = MarkAmbiguous
+		br.Confidence = 0
 	}
-	return
+	return br
 }
 
-type dsbrec struct {
-	xywh        []float64
-	contestName string
-	cselName    string
-}
-type dsbreca []dsbrec
-
-func (a *dsbreca) Less(i, j int) bool {
-	if (*a)[i].contestName < (*a)[i].contestName {
-		return true
-	}
-	if (*a)[i].contestName > (*a)[i].contestName {
-		return false
+// measureScannedBubbles measures the bubbles of the identified style, telling dark from light on flat
+func (s *Scanner) measureScannedBubbles(it, flat *image.Gray) (result *ScanResult) {
+	result = &ScanResult{Contests: make(map[string]*ContestResult)}
+	if s.style >= len(s.t.styles) {
+		return
 	}
-	if (*a)[i].cselName < (*a)[i].cselName {
-		return true
+	var contestNames []string
+	var conout *ContestResult
+	// bubbles are sorted by contest
+	for i := range s.t.styles[s.style] {
+		tb := &s.t.styles[s.style][i]
+		if conout == nil || tb.contest != contestNames[len(contestNames)-1] {
+			contestNames = append(contestNames, tb.contest)
+			conout = &ContestResult{Selections: make(map[string]*BubbleResult)}
+			result.Contests[tb.contest] = conout
+		}
+		br := s.measureBubble(flat, tb, nil)
+		s.debug("%s\t%s\t%d/%d dark/all px, %.1f/%.1f dark/all area\n", tb.contest, tb.selection, br.DarkCount, br.PxCount, br.DarkArea, br.Area)
+		if br.Unreadable {
+			s.debug("%s\t%s\tonly %.1f area clear of printing, needs review\n", tb.contest, tb.selection, br.Area)
+			result.flagReview(ReviewUnreadableBubble, tb.contest, tb.selection)
+		} else if br.Mark == MarkAmbiguous {
+			s.debug("%s\t%s\tambiguous fill %f, needs review\n", tb.contest, tb.selection, br.Fill)
+			result.flagReview(ReviewAmbiguousMark, tb.contest, tb.selection)
+		}
+		br.Shape = s.markShape(flat, tb, br)
+		if br.Shape != ShapeNone && br.Shape != ShapeFill {
+			s.debug("%s\t%s\t%s mark, needs review\n", tb.contest, tb.selection, br.Shape)
+			result.flagReview(ReviewUnusualMark, tb.contest, tb.selection)
+		}
+		if tb.writeIn != nil {
+			br.WriteIn = s.writeIn(it, flat, *tb.writeIn, br)
+			if br.WriteIn != nil {
+				s.debug("%s\t%s\twrite-in, ink %f\n", tb.contest, tb.selection, br.WriteIn.Ink)
+				result.flagReview(ReviewWriteIn, tb.contest, tb.selection)
+			}
+		}
+		conout.Selections[tb.selection] = br
 	}
-	if (*a)[i].cselName > (*a)[i].cselName {
-		return false
+	for _, contestName := range contestNames {
+		conout := result.Contests[contestName]
+		conout.tally(s.t.bj.VoteFor[contestName])
+		if conout.Status == ContestOvervote {
+			s.debug("%s\tovervote %d marks, vote for %d\n", contestName, conout.Votes, conout.VoteFor)
+		}
 	}
-	return false
-}
-func (a *dsbreca) Swap(i, j int) {
-	t := (*a)[i]
-	(*a)[i] = (*a)[j]
-	(*a)[j] = t
-}
-func (a *dsbreca) Len() int {
-	return len(*a)
+	return
 }
 
-func (s *Scanner) debugScannedBubbles(it *image.YCbCr) error {
+func (s *Scanner) debugScannedBubbles(it, flat *image.Gray) error {
 	imout, err := os.Create(s.BubblesPngPath)
 	if err != nil {
-		return fmt.Errorf("%s: %s", s.BubblesPngPath, err)
+		return newError(ReasonDebugOutput, err, "%s", s.BubblesPngPath)
 	}
 	defer imout.Close()
 
-	recs := make([]dsbrec, 0, 100)
+	var recs []templateBubble
 	maxWidth := 0.0
 	maxHeight := 0.0
-	for _, ballotType := range s.Bj.Bubbles {
-		for contestName, csels := range ballotType {
-			for cselName, xywh := range csels {
-				recs = append(recs, dsbrec{xywh, contestName, cselName})
-				maxWidth = fmax(maxWidth, xywh[2])
-				maxHeight = fmax(maxHeight, xywh[3])
-			}
+	if s.style < len(s.t.styles) {
+		recs = s.t.styles[s.style]
+		for _, rec := range recs {
+			maxWidth = fmax(maxWidth, rec.rect.w)
+			maxHeight = fmax(maxHeight, rec.rect.h)
 		}
 	}
-	sort.Sort(((*dsbreca)(&recs)))
-	maxWidth = math.Ceil(maxWidth * s.origPxPerPt)
-	maxHeight = math.Ceil(maxHeight * s.origPxPerPt)
+	maxWidth = math.Ceil(maxWidth)
+	maxHeight = math.Ceil(maxHeight)
 	oiw := int(maxWidth) * 4
 	oih := int(maxHeight) * 4 * len(recs)
 	orect := image.Rect(0, 0, oiw, oih)
 	oi := image.NewNRGBA(orect)
-	opngBounds := s.orig.Bounds()
 	for i, rec := range recs {
-		xywh := rec.xywh
-		darkCount := 0
-		pxCount := 0
-		// (printx,printy) coord in pt from bottom left
-		printx := xywh[0]
-		printy := xywh[1]
 		// coords in orig png, bottom left pixel
-		opngx := printx * s.origPxPerPt
-		opngy := float64(opngBounds.Max.Y) - (printy * s.origPxPerPt)
+		opngx := rec.rect.x
+		opngy := rec.rect.y + rec.rect.h
 
 		outy := (int(maxHeight) * 4 * (i + 1)) - 1
-		outWidthPx := int(math.Ceil(xywh[2] * 4 * s.origPxPerPt))
-		outHeightPx := int(math.Ceil(xywh[3] * 4 * s.origPxPerPt))
-		centerY := outHeightPx / 2
-		minsamplex := outWidthPx / 10
-		maxsamplex := (outWidthPx * 9) / 10
+		outWidthPx := int(math.Ceil(rec.rect.w * 4))
+		outHeightPx := int(math.Ceil(rec.rect.h * 4))
 		for iy := 0; iy < outHeightPx; iy++ {
 			dy := opngy - (float64(iy) * 0.25)
 			for ix := 0; ix < outWidthPx; ix++ {
 				pi := ((outy - iy) * oi.Stride) + (ix * 4)
 				dx := opngx + (float64(ix) * 0.25)
 				sx, sy := s.origToScanned.Transform(dx, dy)
-				oc := ImageBiCatrom(it, sx, sy)
-				if (iy == centerY || iy == (centerY-8) || iy == (centerY+8)) && (ix%16 == 0) && (ix > minsamplex) && (ix < maxsamplex) {
-					oc.G = 255
-					oc.R /= 2
-					oc.B /= 2
-					syv := YBiCatrom(it, sx, sy)
-					if syv < s.scanThresh {
-						darkCount++
-					}
-					pxCount++
-				}
-				oi.Pix[pi] = oc.R
-				oi.Pix[pi+1] = oc.G
-				oi.Pix[pi+2] = oc.B
-				oi.Pix[pi+3] = oc.A
+				v := s.sample(it, sx, sy)
+				oi.Pix[pi] = v
+				oi.Pix[pi+1] = v
+				oi.Pix[pi+2] = v
+				oi.Pix[pi+3] = 0xff
 			}
 		}
-		// TODO: record mediocre matches with 30%-70% fill, flag for inspection
-		// TODO: measure extraneous marks in ballot and flag for review
-		s.debug("%s\t%s\t%d/%d dark/all px (debug)\n", rec.contestName, rec.cselName, darkCount, pxCount)
-		if darkCount > ((pxCount * 7) / 10) {
+		// tint the samples green
+		br := s.measureBubble(flat, &recs[i], func(x, y float64, dark bool) {
+			ix := int((x - opngx) * 4)
+			iy := int((opngy - y) * 4)
+			pi := ((outy - iy) * oi.Stride) + (ix * 4)
+			oi.Pix[pi] /= 2
+			oi.Pix[pi+1] = 255
+			oi.Pix[pi+2] /= 2
+		})
+		s.debug("%s\t%s\t%d/%d dark/all px (debug)\n", rec.contest, rec.selection, br.DarkCount, br.PxCount)
+		mark := br.Mark
+		if mark != MarkBlank {
+			// green bar for marked, yellow for ambiguous
 			oc := color.RGBA{0, 255, 0, 255}
+			if mark == MarkAmbiguous {
+				oc.R = 255
+			}
 			for iy := 0; iy < outHeightPx; iy++ {
 				for ix := 0; ix < 3; ix++ {
 					pi := ((outy - iy) * oi.Stride) + (ix * 4)
@@ -1047,17 +1025,60 @@ func (s *Scanner) debugScannedBubbles(it *image.YCbCr) error {
 type DrawSettings struct {
 	PageSize   []float64 `json:"pagesize"`
 	PageMargin float64   `json:"pageMargin"`
+
+	// Barcode is where the ballot style, precinct and serial number are printed, if anywhere
+	Barcode *BarcodeSettings `json:"barcode,omitempty"`
+
+	// Registration is how scans are fitted to the template, RegistrationBorder or RegistrationFiducial.
+	// Empty is RegistrationBorder.
+	Registration string `json:"registration,omitempty"`
+
+	// Fiducials are the solid marks printed for RegistrationFiducial,
+	// each [x,y, width,height] in points from the bottom left of the page, like bubbles.
+	Fiducials [][]float64 `json:"fiducials,omitempty"`
+
+	// Dropout is ink the scanner should not see, on the template or on scans, if any
+	Dropout *DropoutSettings `json:"dropout,omitempty"`
 	// TODO: lots of fields ignored
 }
 
 // {"csel1": [44.2, 491.4000000000001, 22.67716535433071, 8.255859375], "csel2": [44.2, 458.2000000000001, 22.67716535433071, 8.255859375]}
 // []float64 is length 4, [x,y, width,height]
+// A write-in selection has 4 more, [x,y, width,height] of the space next to its bubble for writing a name.
 type ContestSelections map[string][]float64
 type Contest map[string]ContestSelections
 
+// selection names in sorted order
+func (cs ContestSelections) names() []string {
+	out := make([]string, 0, len(cs))
+	for name := range cs {
+		out = append(out, name)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// contest names in sorted order
+func (c Contest) names() []string {
+	out := make([]string, 0, len(c))
+	for name := range c {
+		out = append(out, name)
+	}
+	sort.Strings(out)
+	return out
+}
+
 type BubblesJson struct {
 	DrawSettings *DrawSettings `json:"draw_settings"`
 
 	// Bubbles is a list per ballot style, indexed in the same order as the source document ballot styles.
 	Bubbles []Contest `json:"bubbles"`
+
+	// Pages describes each side of each sheet of a multi-page ballot.
+	// If empty the ballot is one page described by Bubbles.
+	Pages []Page `json:"pages,omitempty"`
+
+	// VoteFor is the "vote for N" limit by contest name.
+	// Contests not listed have no known limit and are never overvoted.
+	VoteFor map[string]int `json:"vote_for,omitempty"`
 }
@@ -0,0 +1,283 @@
+package scan
+
+import (
+	"image"
+	"math"
+	"sort"
+)
+
+// MarkShape is what kind of mark a voter made on or around a bubble.
+// Anything but a filled bubble is left to voter-intent review under the state's rules.
+type MarkShape string
+
+const (
+	// ShapeNone is no ink on or around the bubble
+	ShapeNone MarkShape = ""
+	// ShapeFill is the bubble filled in, wholly or partly
+	ShapeFill MarkShape = "fill"
+	// ShapeCheck is a tick, two strokes meeting at a point
+	ShapeCheck MarkShape = "check"
+	// ShapeX is two strokes crossing
+	ShapeX MarkShape = "x"
+	// ShapeLine is one stroke through the bubble
+	ShapeLine MarkShape = "line"
+	// ShapeCircle is a loop drawn around the bubble, or around the name next to it passing close by, with the bubble left empty
+	ShapeCircle MarkShape = "circle"
+	// ShapeOther is ink that is none of these, a scribble or a stray mark
+	ShapeOther MarkShape = "other"
+)
+
+// Ink is looked for out to this many bubble radii from the bubble's center.
+// Strokes are fitted to ink inside shapeStrokeScale radii, a loop around the bubble to ink beyond shapeRingScale.
+const shapeAroundScale = 2.5
+const shapeStrokeScale = 1.5
+const shapeRingScale = 1.25
+
+// spacing of samples looking for a mark's shape, in points, coarser than any SampleGrid as it covers more of the page
+const shapeStep = 0.75
+
+// strokes are fitted with a band this wide, in points, a little wider than a pen line
+const shapeStrokeWidth = 2.0
+
+// Less fill than this inside the bubble is no ink in it at all
+const shapeMinFill = 0.02
+
+// The ring around a bubble is cut into shapeSectors by angle; a loop has at least shapeMinSectorDark dark samples
+// in at least shapeCircleSectors of them, above and below the bubble.
+const shapeSectors = 8
+const shapeMinSectorDark = 3
+const shapeCircleSectors = 4
+
+// Ink around a bubble that isn't filled is only a mark if at least this many samples of it touch each other.
+// Fewer is the sliver of a printed outline a pixel or so off, or specks.
+const shapeMinInk = 10
+
+// One or two strokes must cover this fraction of the ink to be a line, check or X
+const shapeStrokeCoverage = 0.85
+
+// the strokes of a check or X are at least this many degrees apart
+const shapeMinStrokeAngle = 30.0
+
+// each stroke of an X has at least this fraction of its ink on either side of the crossing
+const shapeMinCrossSide = 0.25
+
+// stroke is a straight band of ink
+type stroke struct {
+	// angle of the stroke's normal, radians
+	angle float64
+	// distance of the band's middle from the origin along the normal
+	offset float64
+	// the points in the band
+	points []FPoint
+	// the rest
+	rest []FPoint
+}
+
+// length along the stroke from its first point to its last
+func (st *stroke) length() float64 {
+	tx := -math.Sin(st.angle)
+	ty := math.Cos(st.angle)
+	lo := math.Inf(1)
+	hi := math.Inf(-1)
+	for _, p := range st.points {
+		d := (p.X * tx) + (p.Y * ty)
+		lo = math.Min(lo, d)
+		hi = math.Max(hi, d)
+	}
+	return hi - lo
+}
+
+// findStroke finds the band width wide holding the most points, trying angles every 5 degrees
+func findStroke(points []FPoint, width float64) *stroke {
+	var best *stroke
+	bestCount := 0
+	offsets := make([]float64, len(points))
+	for deg := 0; deg < 180; deg += 5 {
+		angle := float64(deg) * math.Pi / 180
+		nx := math.Cos(angle)
+		ny := math.Sin(angle)
+		for i, p := range points {
+			offsets[i] = (p.X * nx) + (p.Y * ny)
+		}
+		sort.Float64s(offsets)
+		lo := 0
+		for hi := range offsets {
+			for offsets[hi]-offsets[lo] > width {
+				lo++
+			}
+			if hi-lo+1 > bestCount {
+				bestCount = hi - lo + 1
+				best = &stroke{angle: angle, offset: (offsets[hi] + offsets[lo]) / 2}
+			}
+		}
+	}
+	if best == nil {
+		return nil
+	}
+	nx := math.Cos(best.angle)
+	ny := math.Sin(best.angle)
+	for _, p := range points {
+		if math.Abs((p.X*nx)+(p.Y*ny)-best.offset) <= width/2 {
+			best.points = append(best.points, p)
+		} else {
+			best.rest = append(best.rest, p)
+		}
+	}
+	return best
+}
+
+// crossSide is the smaller fraction of a's points on one side of where b crosses it, 0 for a stroke that ends there
+func crossSide(a, b *stroke) float64 {
+	// solve p.(ax,ay) = a.offset, p.(bx,by) = b.offset for the crossing p
+	ax, ay := math.Cos(a.angle), math.Sin(a.angle)
+	bx, by := math.Cos(b.angle), math.Sin(b.angle)
+	det := (ax * by) - (ay * bx)
+	if det == 0 {
+		return 0
+	}
+	px := ((a.offset * by) - (ay * b.offset)) / det
+	py := ((ax * b.offset) - (a.offset * bx)) / det
+	at := (px * -ay) + (py * ax)
+	before := 0
+	for _, p := range a.points {
+		if (p.X*-ay)+(p.Y*ax) < at {
+			before++
+		}
+	}
+	after := len(a.points) - before
+	return float64(imin(before, after)) / float64(len(a.points))
+}
+
+// largestInk is the number of points in the largest group of ink points touching each other, points being on a grid step apart
+func largestInk(points []FPoint, step float64) int {
+	if len(points) == 0 {
+		return 0
+	}
+	cells := make(map[point]bool, len(points))
+	for _, p := range points {
+		cells[point{int(math.Floor(((p.X - points[0].X) / step) + 0.5)), int(math.Floor(((p.Y - points[0].Y) / step) + 0.5))}] = true
+	}
+	largest := 0
+	var stack []point
+	for start := range cells {
+		if !cells[start] {
+			continue
+		}
+		cells[start] = false
+		stack = append(stack[:0], start)
+		count := 0
+		for len(stack) > 0 {
+			c := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			count++
+			for dy := -1; dy <= 1; dy++ {
+				for dx := -1; dx <= 1; dx++ {
+					n := point{c.x + dx, c.y + dy}
+					if cells[n] {
+						cells[n] = false
+						stack = append(stack, n)
+					}
+				}
+			}
+		}
+		if count > largest {
+			largest = count
+		}
+	}
+	return largest
+}
+
+// markShape looks at the ink on and around the bubble tb to tell what kind of mark it is, br being its measurement
+func (s *Scanner) markShape(it *image.Gray, tb *templateBubble, br *BubbleResult) MarkShape {
+	band := s.fillBand()
+	r := tb.rect
+	if br.Fill > band.High {
+		return ShapeFill
+	}
+	rx := r.w / 2
+	ry := r.h / 2
+	ex := r.x + rx
+	ey := r.y + ry
+	step := shapeStep * s.t.pxPerPt
+	margin := s.inkMargin(r)
+	var ink []FPoint
+	var sectorDark [shapeSectors]int
+	for y := ey - (ry * shapeAroundScale); y < ey+(ry*shapeAroundScale); y += step {
+		for x := ex - (rx * shapeAroundScale); x < ex+(rx*shapeAroundScale); x += step {
+			u := (x - ex) / rx
+			v := (y - ey) / ry
+			rho := math.Hypot(u, v)
+			if rho > shapeAroundScale || s.t.bubbleInk(tb, x, y, margin) {
+				continue
+			}
+			sx, sy := s.origToScanned.Transform(x, y)
+			if s.sample(it, sx, sy) >= s.scanThresh {
+				continue
+			}
+			if rho <= shapeStrokeScale {
+				ink = append(ink, FPoint{X: x - ex, Y: y - ey})
+			}
+			if rho >= shapeRingScale {
+				sector := int((math.Atan2(v, u) + math.Pi) / (2 * math.Pi) * shapeSectors)
+				sectorDark[sector%shapeSectors]++
+			}
+		}
+	}
+
+	if br.Fill < shapeMinFill {
+		sectors := 0
+		above := false
+		below := false
+		for i, n := range sectorDark {
+			if n < shapeMinSectorDark {
+				continue
+			}
+			sectors++
+			// sectors start at -pi, to the left, and go round through above (y up the page is negative)
+			if i < shapeSectors/2 {
+				above = true
+			} else {
+				below = true
+			}
+		}
+		if sectors >= shapeCircleSectors && above && below {
+			return ShapeCircle
+		}
+		return ShapeNone
+	}
+
+	if largestInk(ink, step) < shapeMinInk {
+		// a blank or ambiguous fill with no mark to classify
+		if br.Fill >= band.Low {
+			return ShapeFill
+		}
+		return ShapeNone
+	}
+
+	width := shapeStrokeWidth * s.t.pxPerPt
+	first := findStroke(ink, width)
+	if first != nil && first.length() >= r.h {
+		coverage := float64(len(first.points)) / float64(len(ink))
+		if coverage >= shapeStrokeCoverage {
+			return ShapeLine
+		}
+		second := findStroke(first.rest, width)
+		if second != nil && second.length() >= r.h/2 {
+			coverage += float64(len(second.points)) / float64(len(ink))
+			apart := math.Abs(first.angle-second.angle) * 180 / math.Pi
+			if apart > 90 {
+				apart = 180 - apart
+			}
+			if coverage >= shapeStrokeCoverage && apart >= shapeMinStrokeAngle {
+				if crossSide(first, second) >= shapeMinCrossSide && crossSide(second, first) >= shapeMinCrossSide {
+					return ShapeX
+				}
+				return ShapeCheck
+			}
+		}
+	}
+	if br.Fill >= band.Low {
+		return ShapeFill
+	}
+	return ShapeOther
+}
@@ -0,0 +1,117 @@
+package scan
+
+import (
+	"image"
+	"math"
+	"testing"
+)
+
+// synthStroke draws a pen line width pixels wide from (x0,y0) to (x1,y1), in bubble radii from the center of bubble xywh
+func synthStroke(im *image.Gray, xywh []float64, x0, y0, x1, y1, width float64) {
+	rx := xywh[2] * synthPxPerPt / 2
+	ry := xywh[3] * synthPxPerPt / 2
+	cx := (xywh[0] * synthPxPerPt) + rx
+	cy := float64(im.Rect.Max.Y) - (xywh[1] * synthPxPerPt) - ry
+	ax, ay := cx+(x0*rx), cy+(y0*ry)
+	bx, by := cx+(x1*rx), cy+(y1*ry)
+	dx, dy := bx-ax, by-ay
+	for y := int(math.Min(ay, by) - width); y < int(math.Max(ay, by)+width); y++ {
+		for x := int(math.Min(ax, bx) - width); x < int(math.Max(ax, bx)+width); x++ {
+			t := fclamp((((float64(x)-ax)*dx)+((float64(y)-ay)*dy))/((dx*dx)+(dy*dy)), 0, 1)
+			if math.Hypot(float64(x)-(ax+(t*dx)), float64(y)-(ay+(t*dy))) <= width/2 {
+				im.Pix[(y*im.Stride)+x] = 0
+			}
+		}
+	}
+}
+
+func TestMarkShape(t *testing.T) {
+	bj := synthBubbles()
+	orig := synthTemplate(&bj, 0)
+	mayor := bj.Bubbles[0]["mayor"]
+	council := bj.Bubbles[0]["council"]
+	synthStroke(orig, mayor["alice"], -0.5, 0, -0.1, 0.8, 2.5)
+	synthStroke(orig, mayor["alice"], -0.1, 0.8, 0.9, -1.3, 2.5)
+	synthStroke(orig, mayor["bob"], -0.8, -0.9, 0.8, 0.9, 2.5)
+	synthStroke(orig, mayor["bob"], -0.8, 0.9, 0.8, -0.9, 2.5)
+	synthStroke(orig, mayor["carol"], -1.3, 0.1, 1.3, -0.1, 2.5)
+	// a loop around the bubble, as 24 short strokes
+	for i := 0; i < 24; i++ {
+		a0 := float64(i) * 2 * math.Pi / 24
+		a1 := float64(i+1) * 2 * math.Pi / 24
+		synthStroke(orig, council["xavier"], 1.8*math.Cos(a0), 1.7*math.Sin(a0), 1.8*math.Cos(a1), 1.7*math.Sin(a1), 2.5)
+	}
+	synthBubble(orig, council["yolanda"], true)
+	scan := synthScan(orig, synthRotation(0.003, 12.4, 9.7), 30)
+	tmpl, err := NewTemplate(&bj, synthTemplate(&bj, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := NewScanner(tmpl).ProcessScannedImage(scan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]map[string]MarkShape{
+		"mayor":   {"alice": ShapeCheck, "bob": ShapeX, "carol": ShapeLine},
+		"council": {"xavier": ShapeCircle, "yolanda": ShapeFill},
+	}
+	unusual := make(map[string]bool)
+	for _, rf := range result.Review {
+		if rf.Reason == ReviewUnusualMark {
+			unusual[rf.Selection] = true
+		}
+	}
+	for contest, shapes := range want {
+		for selection, shape := range shapes {
+			br := result.Contests[contest].Selections[selection]
+			if br.Shape != shape {
+				t.Errorf("%s %s shape %q, want %q (fill %f)", contest, selection, br.Shape, shape, br.Fill)
+			}
+			if unusual[selection] != (shape != ShapeFill) {
+				t.Errorf("%s %s %s, unusual mark review %v", contest, selection, shape, unusual[selection])
+			}
+		}
+	}
+}
+
+func TestLargestInk(t *testing.T) {
+	var points []FPoint
+	// a diagonal run of 5 and a pair apart from it
+	for i := 0; i < 5; i++ {
+		points = append(points, FPoint{X: float64(i) * 1.5, Y: float64(i) * 1.5})
+	}
+	points = append(points, FPoint{X: 30, Y: 0}, FPoint{X: 31.5, Y: 0})
+	if n := largestInk(points, 1.5); n != 5 {
+		t.Errorf("largest %d, want 5", n)
+	}
+	if n := largestInk(nil, 1.5); n != 0 {
+		t.Errorf("no points, largest %d", n)
+	}
+}
+
+// A blank ballot has nothing to review, whatever the threshold and with the local warp
+// leaving bubble outlines a pixel or so off the template.
+func TestMarkShapeBlank(t *testing.T) {
+	bj := synthBubbles()
+	orig := synthTemplate(&bj, 0)
+	tmpl, err := NewTemplate(&bj, orig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, threshold := range []ThresholdMethod{ThresholdNiblack, ThresholdSauvola} {
+		for _, theta := range []float64{0.003, 0.01, -0.007} {
+			for _, shift := range [][2]float64{{12.4, 9.7}, {3.5, 40.25}, {-7.8, 5.1}} {
+				s := NewScanner(tmpl)
+				s.Threshold = threshold
+				s.LocalWarp = true
+				result, err := s.ProcessScannedImage(synthScan(orig, synthRotation(theta, shift[0], shift[1]), 30))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if result.NeedsReview {
+					t.Errorf("threshold %d rotation %.3f shift %v: review %v", threshold, theta, shift, result.Review)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package scan
+
+import (
+	"image"
+	"math"
+)
+
+// A style whose bubbles are mostly missing from the sheet is probably the wrong style.
+// Below this score the style guess is flagged for review.
+const minStyleScore = 0.75
+
+// number of points sampled around each bubble outline
+const outlineSamples = 24
+
+// The printed outline is looked for from this fraction of a bubble's radius to this one
+const outlineInner = 0.8
+const outlineOuter = 1.15
+
+// outlinePresence measures how much of a bubble's printed outline dark finds, in template pixels.
+// Samples around the ellipse inscribed in the bubble rect, taking the darkest pixel along a short radial segment at each angle.
+// Returns the fraction of angles that found ink.
+func outlinePresence(r pxRect, dark func(x, y float64) bool) float64 {
+	// center and radii in orig png pixels
+	rx := r.w / 2
+	ry := r.h / 2
+	cx := r.x + rx
+	cy := r.y + ry
+	found := 0
+	for i := 0; i < outlineSamples; i++ {
+		theta := float64(i) * 2 * math.Pi / outlineSamples
+		costh := math.Cos(theta)
+		sinth := math.Sin(theta)
+		for r := outlineInner; r <= outlineOuter; r += 0.05 {
+			if dark(cx+(rx*r*costh), cy+(ry*r*sinth)) {
+				found++
+				break
+			}
+		}
+	}
+	return float64(found) / outlineSamples
+}
+
+// bubbleOutline measures how much of a bubble's printed outline is present on the scan.
+func (s *Scanner) bubbleOutline(it *image.Gray, r pxRect) float64 {
+	return outlinePresence(r, func(x, y float64) bool {
+		sx, sy := s.origToScanned.Transform(x, y)
+		return s.sample(it, sx, sy) < s.scanThresh
+	})
+}
+
+// identifyStyle picks the ballot style whose bubbles are printed on this sheet.
+// Each style scores the mean outline presence of its bubbles.
+// Ties go to the style with more bubbles, so a style whose bubbles are a subset of another's doesn't win by default.
+func (s *Scanner) identifyStyle(it *image.Gray) (style int, scores []float64) {
+	if len(s.t.styles) < 2 {
+		return 0, nil
+	}
+	scores = make([]float64, len(s.t.styles))
+	style = -1
+	bestCount := 0
+	for i, bubbles := range s.t.styles {
+		count := len(bubbles)
+		sum := 0.0
+		for _, tb := range bubbles {
+			sum += s.bubbleOutline(it, tb.rect)
+		}
+		if count > 0 {
+			scores[i] = sum / float64(count)
+		}
+		s.debug("style %d %d bubbles, outline score %f\n", i, count, scores[i])
+		if style < 0 || scores[i] > scores[style]+0.001 || (math.Abs(scores[i]-scores[style]) <= 0.001 && count > bestCount) {
+			style = i
+			bestCount = count
+		}
+	}
+	return style, scores
+}
@@ -0,0 +1,151 @@
+package scan
+
+import (
+	"image"
+	"reflect"
+	"testing"
+)
+
+var synthBarcodeRect = []float64{300, 100, 200, 30}
+
+// synthBarcode clears xywh (points from bottom left) and draws widths across it, if any
+func synthBarcode(im *image.Gray, xywh []float64, widths []float64) {
+	h := im.Rect.Max.Y
+	x0 := int(xywh[0] * synthPxPerPt)
+	y0 := h - int((xywh[1]+xywh[3])*synthPxPerPt)
+	x1 := x0 + int(xywh[2]*synthPxPerPt)
+	y1 := y0 + int(xywh[3]*synthPxPerPt)
+	synthFill(im, x0, y0, x1, y1, 255)
+	if widths == nil {
+		return
+	}
+	modules := 20.0
+	for _, w := range widths {
+		modules += w
+	}
+	line := renderBarcodeLine(widths, float64(x1-x0)/modules)
+	for y := y0; y < y1; y++ {
+		for i, v := range line {
+			if x0+i < x1 {
+				im.Pix[(y*im.Stride)+x0+i] = uint8(v)
+			}
+		}
+	}
+}
+
+// synthStyleTemplate is the style 0 page with a blank barcode region
+func synthStyleTemplate(t *testing.T, bj *BubblesJson) *Template {
+	bj.DrawSettings.Barcode = &BarcodeSettings{Rect: synthBarcodeRect, Symbology: SymbologyCode128, Style: []int{0, 2}}
+	orig := synthTemplate(bj, 0)
+	synthBarcode(orig, synthBarcodeRect, nil)
+	tmpl, err := NewTemplate(bj, orig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tmpl
+}
+
+func TestIdentifyStyle(t *testing.T) {
+	bj := synthBubbles()
+	tmpl := synthStyleTemplate(t, &bj)
+	orig := synthTemplate(&bj, 1)
+	synthBarcode(orig, synthBarcodeRect, nil)
+	synthBubble(orig, bj.Bubbles[1]["mayor"]["bob"], true)
+	result, err := NewScanner(tmpl).ProcessScannedImage(synthScan(orig, synthRotation(0.003, 12.4, 9.7), 30))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Style != 1 || result.NeedsReview {
+		t.Errorf("style %d scores %v review %v, want style 1", result.Style, result.StyleScores, result.Review)
+	}
+	want := map[string]map[string]bool{
+		"mayor":   {"bob": true},
+		"council": {},
+	}
+	if got := result.Marked(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+// A sheet with none of the styles' bubbles on it is not confidently any of them,
+// and is flagged once even when its barcode names a style that doesn't exist either.
+func TestIdentifyStyleUnknown(t *testing.T) {
+	bj := synthBubbles()
+	tmpl := synthStyleTemplate(t, &bj)
+	for _, widths := range [][]float64{nil, code128Widths("050042")} {
+		orig := synthTemplate(&bj, 0)
+		synthBarcode(orig, synthBarcodeRect, widths)
+		for _, bubbles := range bj.Bubbles {
+			for _, csels := range bubbles {
+				for _, xywh := range csels {
+					synthBarcode(orig, []float64{xywh[0] - 2, xywh[1] - 2, xywh[2] + 4, xywh[3] + 4}, nil)
+				}
+			}
+		}
+		result, err := NewScanner(tmpl).ProcessScannedImage(synthScan(orig, synthRotation(0.003, 12.4, 9.7), 30))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (result.Barcode != nil) != (widths != nil) {
+			t.Errorf("barcode %+v", result.Barcode)
+		}
+		if !reflect.DeepEqual(result.Review, []ReviewFlag{{Reason: ReviewUnknownStyle}}) {
+			t.Errorf("barcode %+v scores %v review %v, want %s once", result.Barcode, result.StyleScores, result.Review, ReviewUnknownStyle)
+		}
+	}
+}
+
+// The barcode picks the style, but printed bubbles that say otherwise are flagged.
+func TestIdentifyStyleBarcode(t *testing.T) {
+	bj := synthBubbles()
+	tmpl := synthStyleTemplate(t, &bj)
+	for _, tc := range []struct {
+		sheet  int
+		review []ReviewFlag
+	}{
+		{1, nil},
+		{0, []ReviewFlag{{Reason: ReviewStyleMismatch}}},
+	} {
+		orig := synthTemplate(&bj, tc.sheet)
+		synthBarcode(orig, synthBarcodeRect, code128Widths("010042"))
+		result, err := NewScanner(tmpl).ProcessScannedImage(synthScan(orig, synthRotation(0.003, 12.4, 9.7), 30))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Barcode == nil || result.Barcode.Style != 1 || result.Style != 1 {
+			t.Errorf("style %d sheet: barcode %v, style %d", tc.sheet, result.Barcode, result.Style)
+		}
+		if !reflect.DeepEqual(result.Review, tc.review) {
+			t.Errorf("style %d sheet: scores %v review %v, want %v", tc.sheet, result.StyleScores, result.Review, tc.review)
+		}
+	}
+}
+
+// An i2of5 barcode sets the style only when its length or check digit can catch a partial read.
+func TestIdentifyStyleI2of5(t *testing.T) {
+	for _, tc := range []struct {
+		check  bool
+		text   string
+		read   bool
+		style  int
+		review []ReviewFlag
+	}{
+		{false, "0142", true, 0, nil},
+		{true, "0142", false, 0, nil},
+		{true, "0147", true, 1, []ReviewFlag{{Reason: ReviewStyleMismatch}}},
+	} {
+		bj := synthBubbles()
+		tmpl := synthStyleTemplate(t, &bj)
+		bj.DrawSettings.Barcode.Symbology = SymbologyI2of5
+		bj.DrawSettings.Barcode.CheckDigit = tc.check
+		orig := synthTemplate(&bj, 0)
+		synthBarcode(orig, synthBarcodeRect, i2of5Widths(tc.text))
+		result, err := NewScanner(tmpl).ProcessScannedImage(synthScan(orig, synthRotation(0.003, 12.4, 9.7), 30))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (result.Barcode != nil) != tc.read || result.Style != tc.style || !reflect.DeepEqual(result.Review, tc.review) {
+			t.Errorf("%s check digit %v: barcode %+v style %d review %v", tc.text, tc.check, result.Barcode, result.Style, result.Review)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package scan
+
+import (
+	"image"
+	"math"
+)
+
+// subpixelOffset refines a whole pixel hotspot match at (bestdx,bestdy) to a fractional offset.
+// The binary match count is flat around its minimum, so the 3x3 neighborhood is scored again
+// by grey level SSD, each patch normalized to zero mean and unit variance so paper and ink
+// brightness don't matter, and a quadratic surface is fitted to those scores.
+func (s *Scanner) subpixelOffset(it *image.Gray, spot *hotspot, bestdx, bestdy int) (fx, fy float64) {
+	if !spot.greyOk {
+		return 0, 0
+	}
+	mx := spot.center.x - (hotspotSize / 2)
+	my := spot.center.y - (hotspotSize / 2)
+	var scores [3][3]float64
+	var scan [hotspotSize * hotspotSize]float64
+	for sy := 0; sy < 3; sy++ {
+		for sx := 0; sx < 3; sx++ {
+			for iy := 0; iy < hotspotSize; iy++ {
+				y := my + bestdy + sy - 1 + iy
+				for ix := 0; ix < hotspotSize; ix++ {
+					x := mx + bestdx + sx - 1 + ix
+					tx, ty := s.origToScanned.Transform(float64(x), float64(y))
+					scan[(hotspotSize*iy)+ix] = float64(s.sample(it, tx, ty))
+				}
+			}
+			if !normalizePatch(scan[:]) {
+				return 0, 0
+			}
+			ssd := 0.0
+			for i, ov := range spot.grey {
+				d := ov - scan[i]
+				ssd += d * d
+			}
+			scores[sy][sx] = ssd
+		}
+	}
+	return quadraticPeak(scores)
+}
+
+// normalizePatch shifts and scales v to zero mean and unit variance.
+// Returns false for a blank patch.
+func normalizePatch(v []float64) bool {
+	sum := 0.0
+	for _, x := range v {
+		sum += x
+	}
+	mean := sum / float64(len(v))
+	sumsq := 0.0
+	for _, x := range v {
+		sumsq += (x - mean) * (x - mean)
+	}
+	if sumsq < 1 {
+		return false
+	}
+	sd := math.Sqrt(sumsq / float64(len(v)))
+	for i, x := range v {
+		v[i] = (x - mean) / sd
+	}
+	return true
+}
+
+// quadraticPeak finds the minimum of a 3x3 grid of scores, v[y][x] for x,y in -1,0,1.
+// Fits f(x,y) = a + bx + cy + dx^2 + exy + fy^2 by least squares and returns where its gradient is zero.
+// Returns (0,0) if the scores aren't bowl shaped or the minimum is outside the grid.
+func quadraticPeak(v [3][3]float64) (fx, fy float64) {
+	// column and row sums
+	var colSum, rowSum [3]float64
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			colSum[j] += v[i][j]
+			rowSum[i] += v[i][j]
+		}
+	}
+	// closed form least squares on the 3x3 grid
+	b := (colSum[2] - colSum[0]) / 6
+	c := (rowSum[2] - rowSum[0]) / 6
+	d := (colSum[0] + colSum[2] - (2 * colSum[1])) / 6
+	f := (rowSum[0] + rowSum[2] - (2 * rowSum[1])) / 6
+	e := (v[2][2] - v[0][2] - v[2][0] + v[0][0]) / 4
+	// [2d e; e 2f] [x y] = -[b c]
+	det := (4 * d * f) - (e * e)
+	if d <= 0 || det <= 0 {
+		return 0, 0
+	}
+	fx = ((-2 * f * b) + (e * c)) / det
+	fy = ((-2 * d * c) + (e * b)) / det
+	if fx < -1 || fx > 1 || fy < -1 || fy > 1 {
+		// fit is off somewhere else, don't trust it
+		return 0, 0
+	}
+	return fx, fy
+}
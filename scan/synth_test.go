@@ -0,0 +1,211 @@
+package scan
+
+import (
+	"image"
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// Synthetic ballots for testing registration: a letter page at 150 dpi with a thick border,
+// rows of random "glyphs" for texture, and bubble outlines.
+
+const synthPxPerPt = 150.0 / 72.0
+
+func synthBubbles() BubblesJson {
+	return BubblesJson{
+		DrawSettings: &DrawSettings{PageSize: []float64{612, 792}, PageMargin: 36},
+		Bubbles: []Contest{
+			{
+				"mayor":   {"alice": {60, 600, 22, 10}, "bob": {60, 570, 22, 10}, "carol": {60, 540, 22, 10}},
+				"council": {"xavier": {60, 400, 22, 10}, "yolanda": {60, 370, 22, 10}},
+			},
+			{
+				"mayor":   {"alice": {60, 640, 22, 10}, "bob": {60, 610, 22, 10}},
+				"council": {"xavier": {60, 300, 22, 10}, "yolanda": {60, 270, 22, 10}},
+			},
+		},
+		VoteFor: map[string]int{"mayor": 1, "council": 1},
+	}
+}
+
+func synthFill(im *image.Gray, x0, y0, x1, y1 int, v uint8) {
+	for y := y0; y < y1; y++ {
+		for x := x0; x < x1; x++ {
+			im.Pix[(y*im.Stride)+x] = v
+		}
+	}
+}
+
+// synthBubble draws the oval inscribed in xywh (points from bottom left), outline or filled
+func synthBubble(im *image.Gray, xywh []float64, filled bool) {
+	h := float64(im.Rect.Max.Y)
+	rx := xywh[2] * synthPxPerPt / 2
+	ry := xywh[3] * synthPxPerPt / 2
+	cx := (xywh[0] * synthPxPerPt) + rx
+	cy := h - (xywh[1] * synthPxPerPt) - ry
+	for y := int(cy - ry - 3); y < int(cy+ry+3); y++ {
+		for x := int(cx - rx - 3); x < int(cx+rx+3); x++ {
+			d := math.Hypot((float64(x)-cx)/rx, (float64(y)-cy)/ry)
+			if (filled && d < 1.0) || math.Abs(d-1.0)*math.Min(rx, ry) < 1.2 {
+				im.Pix[(y*im.Stride)+x] = 0
+			}
+		}
+	}
+}
+
+// synthTemplate draws the page for one ballot style
+func synthTemplate(bj *BubblesJson, style int) *image.Gray {
+	w := int(bj.DrawSettings.PageSize[0] * synthPxPerPt)
+	h := int(bj.DrawSettings.PageSize[1] * synthPxPerPt)
+	orig := image.NewGray(image.Rect(0, 0, w, h))
+	synthFill(orig, 0, 0, w, h, 255)
+	m := int(bj.DrawSettings.PageMargin * synthPxPerPt)
+	synthFill(orig, m, m, w-m, m+8, 0)
+	synthFill(orig, m, h-m-8, w-m, h-m, 0)
+	synthFill(orig, m, m, m+8, h-m, 0)
+	synthFill(orig, w-m-8, m, w-m, h-m, 0)
+	rnd := rand.New(rand.NewSource(1))
+	for ly := m + 30; ly < h-m-30; ly += 28 {
+		x := m + 150
+		for x < w-m-30 {
+			gw := rnd.Intn(9) + 2
+			if rnd.Intn(6) == 0 {
+				// word space
+				x += 12
+				continue
+			}
+			gh := rnd.Intn(12) + 4
+			synthFill(orig, x, ly+(16-gh), x+gw, ly+16, 0)
+			x += gw + rnd.Intn(4) + 2
+		}
+	}
+	for _, csels := range bj.Bubbles[style] {
+		for _, xywh := range csels {
+			px := int(xywh[0]*synthPxPerPt) - 4
+			py := h - int(xywh[1]*synthPxPerPt) - int(xywh[3]*synthPxPerPt) - 4
+			synthFill(orig, px, py, px+int(xywh[2]*synthPxPerPt)+8, py+int(xywh[3]*synthPxPerPt)+8, 255)
+			synthBubble(orig, xywh, false)
+		}
+	}
+	return orig
+}
+
+// synthAffine is scan = [a b; c d] * template + [tx ty]
+type synthAffine struct {
+	a, b, c, d, tx, ty float64
+}
+
+func synthRotation(theta, tx, ty float64) synthAffine {
+	return synthAffine{math.Cos(theta), -math.Sin(theta), math.Sin(theta), math.Cos(theta), tx, ty}
+}
+
+func (sa synthAffine) Transform(x, y float64) (float64, float64) {
+	return (sa.a * x) + (sa.b * y) + sa.tx, (sa.c * x) + (sa.d * y) + sa.ty
+}
+
+func (sa synthAffine) TransformInt(x, y int) (int, int) {
+	fx, fy := sa.Transform(float64(x), float64(y))
+	return int(fx), int(fy)
+}
+
+func (sa synthAffine) Inverse(x, y float64) (float64, float64) {
+	det := (sa.a * sa.d) - (sa.b * sa.c)
+	fx := x - sa.tx
+	fy := y - sa.ty
+	return ((sa.d * fx) - (sa.b * fy)) / det, ((-sa.c * fx) + (sa.a * fy)) / det
+}
+
+// synthHomography is a perspective transform, scan = h * template
+type synthHomography [9]float64
+
+func (sh synthHomography) Transform(x, y float64) (float64, float64) {
+	return MatrixTransform{sh[:]}.Transform(x, y)
+}
+
+func (sh synthHomography) TransformInt(x, y int) (int, int) {
+	return MatrixTransform{sh[:]}.TransformInt(x, y)
+}
+
+func (sh synthHomography) Inverse(x, y float64) (float64, float64) {
+	// adjugate of h, inverse up to scale
+	inv := []float64{
+		(sh[4] * sh[8]) - (sh[5] * sh[7]), (sh[2] * sh[7]) - (sh[1] * sh[8]), (sh[1] * sh[5]) - (sh[2] * sh[4]),
+		(sh[5] * sh[6]) - (sh[3] * sh[8]), (sh[0] * sh[8]) - (sh[2] * sh[6]), (sh[2] * sh[3]) - (sh[0] * sh[5]),
+		(sh[3] * sh[7]) - (sh[4] * sh[6]), (sh[1] * sh[6]) - (sh[0] * sh[7]), (sh[0] * sh[4]) - (sh[1] * sh[3]),
+	}
+	return MatrixTransform{inv}.Transform(x, y)
+}
+
+// synthWarp is a known template to scan transform that synthScan can run backwards
+type synthWarp interface {
+	Inverse(x, y float64) (float64, float64)
+}
+
+// synthScan renders the template through the transform onto a page pad pixels bigger, bilinear sampled
+func synthScan(orig *image.Gray, sw synthWarp, pad int) *image.Gray {
+	w := orig.Rect.Max.X + pad
+	h := orig.Rect.Max.Y + pad
+	out := image.NewGray(image.Rect(0, 0, w, h))
+	pix := func(x, y int) float64 {
+		return float64(orig.Pix[(y*orig.Stride)+x])
+	}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			ox, oy := sw.Inverse(float64(x), float64(y))
+			ix := int(math.Floor(ox))
+			iy := int(math.Floor(oy))
+			v := 255.0
+			if ix >= 0 && iy >= 0 && ix+1 < orig.Rect.Max.X && iy+1 < orig.Rect.Max.Y {
+				ax := ox - float64(ix)
+				ay := oy - float64(iy)
+				v = (((pix(ix, iy) * (1 - ax)) + (pix(ix+1, iy) * ax)) * (1 - ay)) + (((pix(ix, iy+1) * (1 - ax)) + (pix(ix+1, iy+1) * ax)) * ay)
+			}
+			out.Pix[(y*out.Stride)+x] = uint8(v)
+		}
+	}
+	return out
+}
+
+// synthHotspotError is the median distance in scan pixels from where the hotspots were matched to where they really are
+func synthHotspotError(aq *AlignmentQuality, want AffineTransform) float64 {
+	dists := make([]float64, len(aq.Hotspots))
+	for i, hm := range aq.Hotspots {
+		wx, wy := want.Transform(hm.X, hm.Y)
+		dists[i] = math.Hypot(hm.ScanX-wx, hm.ScanY-wy)
+	}
+	sort.Float64s(dists)
+	return dists[len(dists)/2]
+}
+
+func TestSubpixelHotspots(t *testing.T) {
+	bj := synthBubbles()
+	orig := synthTemplate(&bj, 0)
+	truth := synthRotation(0.004, 21.37, 14.62)
+	scan := synthScan(orig, truth, 40)
+
+	tmpl, err := NewTemplate(&bj, orig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// start from the top line, only good to a pixel or so; the border corners are too good to leave anything to refine
+	tmpl.corners = nil
+	var errs [2]float64
+	for i, subpixel := range []bool{false, true} {
+		s := NewScanner(tmpl)
+		s.WholePixelHotspots = !subpixel
+		_, err = s.ProcessScannedImage(scan)
+		if err != nil {
+			t.Fatal(err)
+		}
+		errs[i] = synthHotspotError(&s.alignment, truth)
+	}
+	t.Logf("median hotspot error whole pixel %f px, sub-pixel %f px", errs[0], errs[1])
+	if errs[1] >= errs[0] {
+		t.Errorf("sub-pixel refinement didn't help: %f px >= %f px", errs[1], errs[0])
+	}
+	if errs[1] > 0.25 {
+		t.Errorf("sub-pixel median hotspot error %f px", errs[1])
+	}
+}
@@ -0,0 +1,270 @@
+package scan
+
+import (
+	"encoding/json"
+	"image"
+	"math"
+	"os"
+)
+
+// Template is a ballot page prepared for scanning: the template image and everything computed from it once.
+// A Template is never modified after NewTemplate, so many Scanners on many goroutines can share one.
+type Template struct {
+	bj BubblesJson
+
+	orig     *image.Gray
+	pxPerPt  float64
+	topLeft  point
+	topRight point
+	thresh   uint8
+
+	// dropout ink whitened from the template and from scans, nil for none
+	dropout *dropout
+
+	// RegistrationBorder or RegistrationFiducial
+	registration string
+
+	// corners of the page border, top left, top right, bottom right, bottom left; nil if the template has no full border
+	corners []FPoint
+
+	hotspots []hotspot
+
+	// a denser grid of hotspots for Scanner.LocalWarp
+	warpHotspots []hotspot
+
+	fiducials []fiducial
+
+	// bubble geometry per ballot style, sorted by contest then selection
+	styles [][]templateBubble
+}
+
+// hotspot is a patch of the template image to find on the scan
+type hotspot struct {
+	center point
+
+	// thresholded patch, 1 for light and 0 for dark
+	patch [hotspotSize * hotspotSize]uint8
+
+	// grey patch normalized to zero mean and unit variance for sub-pixel matching
+	grey [hotspotSize * hotspotSize]float64
+	// greyOk is false for a flat patch that can't be normalized
+	greyOk bool
+
+	// normalized grey patches from each coarser pyramid level, centered on the same point and so covering more of the page
+	coarse   [pyramidLevels - 1][hotspotSize * hotspotSize]float64
+	coarseOk [pyramidLevels - 1]bool
+}
+
+// pxRect is a rectangle in template image pixels, (x,y) the top left corner
+type pxRect struct {
+	x, y, w, h float64
+}
+
+type templateBubble struct {
+	contest   string
+	selection string
+	rect      pxRect
+
+	// outlined is true if the bubble's outline is drawn on the template image.
+	// The template is one style's page, so other styles' bubbles may not be.
+	outlined bool
+
+	// the space for writing a name next to a write-in bubble, nil for other bubbles
+	writeIn *pxRect
+}
+
+// ReadBubblesJson loads a bubbles json file
+func ReadBubblesJson(path string) (*BubblesJson, error) {
+	fin, err := os.Open(path)
+	if err != nil {
+		return nil, newError(ReasonTemplateLoad, err, "%s", path)
+	}
+	defer fin.Close()
+	bj := new(BubblesJson)
+	jd := json.NewDecoder(fin)
+	err = jd.Decode(bj)
+	if err != nil {
+		return nil, newError(ReasonTemplateLoad, err, "%s: bad bubbles json", path)
+	}
+	return bj, nil
+}
+
+// ReadTemplate loads the template image for one page of bj
+func ReadTemplate(bj *BubblesJson, origname string) (*Template, error) {
+	r, err := os.Open(origname)
+	if err != nil {
+		return nil, newError(ReasonTemplateLoad, err, "%s", origname)
+	}
+	defer r.Close()
+	orig, format, err := image.Decode(r)
+	if err != nil {
+		return nil, newError(ReasonTemplateLoad, err, "%s: %v", origname, format)
+	}
+	return NewTemplate(bj, orig)
+}
+
+// NewTemplate prepares one page of a ballot, bj as from BubblesJson.Page(), and its rendered image for scanning.
+func NewTemplate(bj *BubblesJson, orig image.Image) (*Template, error) {
+	orect := orig.Bounds()
+	if orect.Min.X != 0 || orect.Min.Y != 0 {
+		return nil, newError(ReasonTemplateLoad, nil, "nonzero origin for original pic. WAT?")
+	}
+	if bj.DrawSettings == nil || len(bj.DrawSettings.PageSize) < 2 {
+		return nil, newError(ReasonTemplateLoad, nil, "bubbles json has no draw_settings pagesize")
+	}
+	if orect.Dx() < 3*hotspotSize || orect.Dy() < 3*hotspotSize {
+		return nil, newError(ReasonTemplateLoad, nil, "template image too small %v", orect)
+	}
+	t := &Template{bj: *bj, orig: lumaPlane(orig)}
+	if bj.DrawSettings.Dropout != nil {
+		var err error
+		t.dropout, err = newDropout(bj.DrawSettings.Dropout)
+		if err != nil {
+			return nil, err
+		}
+		t.dropout.apply(orig, t.orig)
+	}
+	origPxPerPtX := float64(orect.Max.X-orect.Min.X) / bj.DrawSettings.PageSize[0]
+	origPxPerPtY := float64(orect.Max.Y-orect.Min.Y) / bj.DrawSettings.PageSize[1]
+	if math.Abs((origPxPerPtY/origPxPerPtX)-1) > 0.01 {
+		return nil, newError(ReasonTemplateLoad, nil, "orig scale not square: mx = %f, my = %f", origPxPerPtX, origPxPerPtY)
+	}
+	t.pxPerPt = (origPxPerPtX + origPxPerPtY) / 2.0
+	t.topLeft = point{
+		x: int(bj.DrawSettings.PageMargin * t.pxPerPt),
+		y: int(bj.DrawSettings.PageMargin * t.pxPerPt),
+	}
+	t.topRight = point{
+		x: int((bj.DrawSettings.PageSize[0] - bj.DrawSettings.PageMargin) * t.pxPerPt),
+		y: int(bj.DrawSettings.PageMargin * t.pxPerPt),
+	}
+	t.thresh = otsuThreshold(yHistogram(t.orig))
+
+	t.registration = bj.DrawSettings.Registration
+	switch t.registration {
+	case "", RegistrationBorder:
+		t.registration = RegistrationBorder
+		if corners, err := findBorderCorners(t.orig, t.thresh); err == nil {
+			t.corners = corners
+		}
+		levels := grayPyramid(t.orig, pyramidLevels)
+		cm := t.newCornerMap()
+		for _, center := range t.findHotspots(nHotspots, cm) {
+			t.hotspots = append(t.hotspots, t.newHotspot(center, levels))
+		}
+		for _, center := range t.findHotspots(nWarpHotspots, cm) {
+			t.warpHotspots = append(t.warpHotspots, t.newHotspot(center, levels))
+		}
+	case RegistrationFiducial:
+		err := t.findFiducials()
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, newError(ReasonTemplateLoad, nil, "unknown registration %q", t.registration)
+	}
+
+	t.styles = make([][]templateBubble, len(bj.Bubbles))
+	for i, ballotType := range bj.Bubbles {
+		for _, contestName := range ballotType.names() {
+			csels := ballotType[contestName]
+			for _, cselName := range csels.names() {
+				xywh := csels[cselName]
+				if len(xywh) != 4 && len(xywh) != 8 {
+					return nil, newError(ReasonTemplateLoad, nil, "style %d %s %s has %d numbers, want 4, or 8 for a write-in", i, contestName, cselName, len(xywh))
+				}
+				tb := templateBubble{
+					contest:   contestName,
+					selection: cselName,
+					rect:      t.pxRect(xywh),
+				}
+				tb.outlined = outlinePresence(tb.rect, t.dark) >= minStyleScore
+				if len(xywh) == 8 {
+					wr := t.pxRect(xywh[4:8])
+					tb.writeIn = &wr
+				}
+				t.styles[i] = append(t.styles[i], tb)
+			}
+		}
+	}
+	return t, nil
+}
+
+// pxRect converts [x,y,width,height] in points from the bottom left of the page to template pixels
+func (t *Template) pxRect(xywh []float64) pxRect {
+	return pxRect{
+		x: xywh[0] * t.pxPerPt,
+		y: float64(t.orig.Rect.Max.Y) - ((xywh[1] + xywh[3]) * t.pxPerPt),
+		w: xywh[2] * t.pxPerPt,
+		h: xywh[3] * t.pxPerPt,
+	}
+}
+
+// A scan can sit this many template pixels off the template after alignment,
+// so bubble samples this close to printed ink are left out along with those on it.
+// A local warp can move things further, see Scanner.inkMargin.
+const printedMargin = 1
+
+// printed is true where the template is dark within margin template pixels of (x,y): the bubble's outline, a number printed inside it.
+// Darkness there on a scan is not a voter's mark.
+func (t *Template) printed(x, y float64, margin int) bool {
+	px := int(math.Floor(x + 0.5))
+	py := int(math.Floor(y + 0.5))
+	for iy := py - margin; iy <= py+margin; iy++ {
+		for ix := px - margin; ix <= px+margin; ix++ {
+			if grayClamped(t.orig, ix, iy) < t.thresh {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// dark is true where the template is dark at (x,y)
+func (t *Template) dark(x, y float64) bool {
+	return grayClamped(t.orig, int(math.Floor(x+0.5)), int(math.Floor(y+0.5))) < t.thresh
+}
+
+// bubbleInk is true where tb's own printing is within margin of (x,y), as printed, or on its outline
+// if the template image doesn't show it.
+func (t *Template) bubbleInk(tb *templateBubble, x, y float64, margin int) bool {
+	if t.printed(x, y, margin) {
+		return true
+	}
+	if tb.outlined {
+		return false
+	}
+	rx := tb.rect.w / 2
+	ry := tb.rect.h / 2
+	d := math.Hypot((x-tb.rect.x-rx)/rx, (y-tb.rect.y-ry)/ry)
+	return d >= outlineInner && d <= outlineOuter
+}
+
+// newHotspot copies the patch centered on (center) out of each level of the template image pyramid
+func (t *Template) newHotspot(center point, levels []*image.Gray) hotspot {
+	hs := hotspot{center: center}
+	mx := center.x - (hotspotSize / 2)
+	my := center.y - (hotspotSize / 2)
+	for iy := 0; iy < hotspotSize; iy++ {
+		for ix := 0; ix < hotspotSize; ix++ {
+			y := t.orig.Pix[((my+iy)*t.orig.Stride)+mx+ix]
+			if y >= t.thresh {
+				hs.patch[(hotspotSize*iy)+ix] = 1
+			}
+			hs.grey[(hotspotSize*iy)+ix] = float64(y)
+		}
+	}
+	hs.greyOk = normalizePatch(hs.grey[:])
+	for li, level := range levels[1:] {
+		shift := uint(li + 1)
+		mx = (center.x >> shift) - (hotspotSize / 2)
+		my = (center.y >> shift) - (hotspotSize / 2)
+		for iy := 0; iy < hotspotSize; iy++ {
+			for ix := 0; ix < hotspotSize; ix++ {
+				hs.coarse[li][(hotspotSize*iy)+ix] = float64(grayClamped(level, mx+ix, my+iy))
+			}
+		}
+		hs.coarseOk[li] = normalizePatch(hs.coarse[li][:])
+	}
+	return hs
+}
@@ -0,0 +1,114 @@
+package scan
+
+import (
+	"image"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestTemplateShared(t *testing.T) {
+	bj := synthBubbles()
+	orig := synthTemplate(&bj, 0)
+	synthBubble(orig, bj.Bubbles[0]["mayor"]["bob"], true)
+	scan := synthScan(orig, synthRotation(0.003, 12.4, 9.7), 30)
+	tmpl, err := NewTemplate(&bj, synthTemplate(&bj, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const scans = 4
+	var results [scans]map[string]map[string]bool
+	var errs [scans]error
+	var wg sync.WaitGroup
+	for i := 0; i < scans; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			result, err := NewScanner(tmpl).ProcessScannedImage(scan)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			results[i] = result.Marked()
+		}(i)
+	}
+	wg.Wait()
+	want := map[string]map[string]bool{
+		"mayor":   {"bob": true},
+		"council": {},
+	}
+	for i := 0; i < scans; i++ {
+		if errs[i] != nil {
+			t.Errorf("scan %d: %v", i, errs[i])
+		} else if !reflect.DeepEqual(results[i], want) {
+			t.Errorf("scan %d: got %v, want %v", i, results[i], want)
+		}
+	}
+}
+
+// synthNumberedTemplate prints a bold candidate number inside each bubble of one contest
+func synthNumberedTemplate(bj *BubblesJson, style int, contest string) *image.Gray {
+	orig := synthTemplate(bj, style)
+	h := orig.Rect.Max.Y
+	for _, xywh := range bj.Bubbles[style][contest] {
+		cx := int((xywh[0] + (xywh[2] / 2)) * synthPxPerPt)
+		cy := h - int((xywh[1]+(xywh[3]/2))*synthPxPerPt)
+		synthFill(orig, cx-7, cy-4, cx+7, cy+4, 0)
+	}
+	return orig
+}
+
+func TestPrintedBubbleContents(t *testing.T) {
+	bj := synthBubbles()
+	orig := synthNumberedTemplate(&bj, 0, "council")
+	synthBubble(orig, bj.Bubbles[0]["council"]["xavier"], true)
+	scan := synthScan(orig, synthRotation(0.003, 12.4, 9.7), 30)
+	tmpl, err := NewTemplate(&bj, synthNumberedTemplate(&bj, 0, "council"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := NewScanner(tmpl).ProcessScannedImage(scan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]map[string]bool{
+		"mayor":   {},
+		"council": {"xavier": true},
+	}
+	if got := result.Marked(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	numbered := result.Contests["council"].Selections["yolanda"]
+	plain := result.Contests["mayor"].Selections["alice"]
+	if numbered.PxCount >= plain.PxCount {
+		t.Errorf("numbered bubble sampled %d px, plain %d, printed number not left out", numbered.PxCount, plain.PxCount)
+	}
+	if numbered.Fill != 0 {
+		t.Errorf("blank numbered bubble fill %f", numbered.Fill)
+	}
+}
+
+// A bubble printed solid on the template has nothing left to measure, and must not pass as a confident blank.
+func TestPrintedBubbleUnreadable(t *testing.T) {
+	bj := synthBubbles()
+	orig := synthTemplate(&bj, 0)
+	synthBubble(orig, bj.Bubbles[0]["council"]["yolanda"], true)
+	tmpl, err := NewTemplate(&bj, orig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scan := synthScan(orig, synthRotation(0.003, 12.4, 9.7), 30)
+	result, err := NewScanner(tmpl).ProcessScannedImage(scan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	br := result.Contests["council"].Selections["yolanda"]
+	if !br.Unreadable || br.Mark != MarkAmbiguous || br.Confidence != 0 {
+		t.Errorf("solid printed bubble unreadable %v mark %s confidence %f", br.Unreadable, br.Mark, br.Confidence)
+	}
+	want := []ReviewFlag{{Reason: ReviewUnreadableBubble, Contest: "council", Selection: "yolanda"}}
+	if !reflect.DeepEqual(result.Review, want) {
+		t.Errorf("review %v, want %v", result.Review, want)
+	}
+}
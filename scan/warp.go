@@ -0,0 +1,166 @@
+package scan
+
+import (
+	"image"
+	"math"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+// ThinPlateSpline is a smooth warp through scattered point pairs, an affine part plus a bending part
+// that carries each source point to near its dest. It bends no more than it must to do that,
+// so it follows a curled or unevenly stretched sheet that no single matrix can.
+type ThinPlateSpline struct {
+	// source points, normalized
+	centers []FPoint
+	// bending weight of each center, for x and y
+	wx []float64
+	wy []float64
+	// affine part, [1 x y] . a on normalized coordinates
+	ax [3]float64
+	ay [3]float64
+
+	// normalization of source coordinates, (x - ox) * scale
+	ox, oy, scale float64
+}
+
+// tpsKernel is the thin-plate radial basis function of squared distance, r^2 log r
+func tpsKernel(r2 float64) float64 {
+	if r2 == 0 {
+		return 0
+	}
+	return r2 * math.Log(r2) / 2
+}
+
+// FitThinPlateSpline fits a spline taking sources to dests. smoothing > 0 trades passing exactly through each pair
+// for less bending, so noisy matches don't make it wobble; it is in units of the sources normalized to a mean distance of sqrt(2) from their center.
+// Returns nil for fewer than three pairs or ones that don't determine a spline, all on a line.
+func FitThinPlateSpline(sources, dests []FPoint, smoothing float64) *ThinPlateSpline {
+	n := len(sources)
+	if n != len(dests) || n < 3 {
+		return nil
+	}
+	centers, norm := normalizePoints(sources)
+	tps := &ThinPlateSpline{
+		centers: centers,
+		scale:   norm.At(0, 0),
+	}
+	tps.ox = -norm.At(0, 2) / tps.scale
+	tps.oy = -norm.At(1, 2) / tps.scale
+
+	// [K + smoothing*I  P] [w]   [v]
+	// [P^T             0] [a] = [0]
+	L := mat.NewDense(n+3, n+3, nil)
+	V := mat.NewDense(n+3, 2, nil)
+	for i, ci := range centers {
+		for j, cj := range centers {
+			dx := ci.X - cj.X
+			dy := ci.Y - cj.Y
+			L.Set(i, j, tpsKernel((dx*dx)+(dy*dy)))
+		}
+		L.Set(i, i, smoothing)
+		L.Set(i, n, 1)
+		L.Set(i, n+1, ci.X)
+		L.Set(i, n+2, ci.Y)
+		L.Set(n, i, 1)
+		L.Set(n+1, i, ci.X)
+		L.Set(n+2, i, ci.Y)
+		V.Set(i, 0, dests[i].X)
+		V.Set(i, 1, dests[i].Y)
+	}
+	var W mat.Dense
+	if err := W.Solve(L, V); err != nil {
+		return nil
+	}
+	for i := 0; i < n+3; i++ {
+		if math.IsNaN(W.At(i, 0)) || math.IsInf(W.At(i, 0), 0) || math.IsNaN(W.At(i, 1)) || math.IsInf(W.At(i, 1), 0) {
+			return nil
+		}
+	}
+	tps.wx = mat.Col(nil, 0, W.Slice(0, n, 0, 2))
+	tps.wy = mat.Col(nil, 1, W.Slice(0, n, 0, 2))
+	for k := 0; k < 3; k++ {
+		tps.ax[k] = W.At(n+k, 0)
+		tps.ay[k] = W.At(n+k, 1)
+	}
+	return tps
+}
+
+func (tps *ThinPlateSpline) Transform(x, y float64) (float64, float64) {
+	nx := (x - tps.ox) * tps.scale
+	ny := (y - tps.oy) * tps.scale
+	ox := tps.ax[0] + (tps.ax[1] * nx) + (tps.ax[2] * ny)
+	oy := tps.ay[0] + (tps.ay[1] * nx) + (tps.ay[2] * ny)
+	for i, c := range tps.centers {
+		dx := nx - c.X
+		dy := ny - c.Y
+		u := tpsKernel((dx * dx) + (dy * dy))
+		ox += tps.wx[i] * u
+		oy += tps.wy[i] * u
+	}
+	return ox, oy
+}
+
+func (tps *ThinPlateSpline) TransformInt(x, y int) (int, int) {
+	ox, oy := tps.Transform(float64(x), float64(y))
+	return int(ox), int(oy)
+}
+
+// about how many hotspots to find for the local warp, many more than for the global fit
+const nWarpHotspots = 80
+
+// warp hotspot matches with more of their pixels wrong than this are left out of the spline
+const maxWarpMatchError = 0.15
+
+// a warp hotspot further than this from the global fit, in scan pixels, is a mismatch rather than a curl
+const maxWarpCorrection = 12.0
+
+// spline smoothing, see FitThinPlateSpline
+const warpSmoothing = 0.001
+
+// localWarp replaces the global fit in origToScanned with a thin-plate spline through the template's dense grid of warp hotspots,
+// each found on the scan starting from where the global fit puts it. If too few are found the global fit stays.
+func (s *Scanner) localWarp(it *image.Gray) {
+	spots := s.t.warpHotspots
+	scanLevels := grayPyramid(it, pyramidLevels)
+	sources := make([]FPoint, 0, len(spots))
+	dests := make([]FPoint, 0, len(spots))
+	warpMax := 0.0
+	for spoti := range spots {
+		spot := &spots[spoti]
+		dx, dy, mismatch := s.matchHotspot(spot, scanLevels)
+		if float64(mismatch)/(hotspotSize*hotspotSize) > maxWarpMatchError {
+			continue
+		}
+		var subdx, subdy float64
+		if !s.WholePixelHotspots {
+			subdx, subdy = s.subpixelOffset(it, spot, dx, dy)
+		}
+		cx := float64(spot.center.x)
+		cy := float64(spot.center.y)
+		gx, gy := s.origToScanned.Transform(cx, cy)
+		sx, sy := s.origToScanned.Transform(cx+float64(dx)+subdx, cy+float64(dy)+subdy)
+		correction := math.Hypot(sx-gx, sy-gy)
+		if correction > maxWarpCorrection {
+			s.debug("warp hotspot %d,%d %f px off the global fit\n", spot.center.x, spot.center.y, correction)
+			continue
+		}
+		warpMax = fmax(warpMax, correction)
+		sources = append(sources, FPoint{X: cx, Y: cy})
+		dests = append(dests, FPoint{X: sx, Y: sy})
+	}
+	if len(sources) < len(spots)/2 {
+		s.debug("only %d of %d warp hotspots found, keeping global fit\n", len(sources), len(spots))
+		return
+	}
+	tps := FitThinPlateSpline(sources, dests, warpSmoothing)
+	if tps == nil {
+		s.debug("no spline through %d warp hotspots, keeping global fit\n", len(sources))
+		return
+	}
+	s.debug("local warp through %d of %d hotspots, largest correction %f px\n", len(sources), len(spots), warpMax)
+	s.globalFit = s.origToScanned
+	s.origToScanned = tps
+	s.alignment.WarpPoints = len(sources)
+	s.alignment.WarpMax = warpMax
+}
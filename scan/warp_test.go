@@ -0,0 +1,147 @@
+package scan
+
+import (
+	"math"
+	"testing"
+)
+
+func TestThinPlateSpline(t *testing.T) {
+	affine := synthAffine{1.02, -0.01, 0.012, 0.99, 12.5, -7.25}
+	bent := func(x, y float64) (float64, float64) {
+		ax, ay := affine.Transform(x, y)
+		return ax + (4 * math.Sin(y/300)), ay + (3 * math.Cos(x/250))
+	}
+	var sources, dests, affineDests []FPoint
+	for y := 50.0; y < 1600; y += 150 {
+		for x := 50.0; x < 1200; x += 150 {
+			sources = append(sources, FPoint{x, y})
+			bx, by := bent(x, y)
+			dests = append(dests, FPoint{bx, by})
+			ax, ay := affine.Transform(x, y)
+			affineDests = append(affineDests, FPoint{ax, ay})
+		}
+	}
+
+	// an affine map needs no bending, anywhere
+	tps := FitThinPlateSpline(sources, affineDests, 0)
+	if tps == nil {
+		t.Fatal("no spline")
+	}
+	for _, p := range []FPoint{{0, 0}, {613, 977}, {1275, 1650}} {
+		x, y := tps.Transform(p.X, p.Y)
+		ax, ay := affine.Transform(p.X, p.Y)
+		if d := math.Hypot(x-ax, y-ay); d > 1e-6 {
+			t.Errorf("affine spline off by %f px at %v", d, p)
+		}
+	}
+
+	// through every point without smoothing, and close to the bend between them
+	tps = FitThinPlateSpline(sources, dests, 0)
+	for i, sp := range sources {
+		x, y := tps.Transform(sp.X, sp.Y)
+		if d := math.Hypot(x-dests[i].X, y-dests[i].Y); d > 1e-6 {
+			t.Errorf("spline misses %v by %f px", sp, d)
+		}
+	}
+	x, y := tps.Transform(425, 875)
+	bx, by := bent(425, 875)
+	if d := math.Hypot(x-bx, y-by); d > 0.1 {
+		t.Errorf("spline off the bend by %f px between points", d)
+	}
+
+	if FitThinPlateSpline(sources[:2], dests[:2], 0) != nil {
+		t.Errorf("spline through two points")
+	}
+}
+
+// synthCurl is a sheet stretched more and more toward the bottom, as a feeder or a curl does
+type synthCurl struct {
+	base   synthAffine
+	amount float64
+	w, h   float64
+}
+
+func (sc synthCurl) bend(x, y float64) (float64, float64) {
+	f := (y / sc.h) * (y / sc.h) * (y / sc.h)
+	return x + (sc.amount * f * ((2 * x / sc.w) - 1)), y + (sc.amount * f / 2)
+}
+
+func (sc synthCurl) Transform(x, y float64) (float64, float64) {
+	return sc.base.Transform(sc.bend(x, y))
+}
+
+func (sc synthCurl) TransformInt(x, y int) (int, int) {
+	fx, fy := sc.Transform(float64(x), float64(y))
+	return int(fx), int(fy)
+}
+
+func (sc synthCurl) Inverse(x, y float64) (float64, float64) {
+	tx, ty := sc.base.Inverse(x, y)
+	// the bend is small, walk back to it
+	ox, oy := tx, ty
+	for i := 0; i < 20; i++ {
+		bx, by := sc.bend(ox, oy)
+		ox -= bx - tx
+		oy -= by - ty
+	}
+	return ox, oy
+}
+
+func TestLocalWarp(t *testing.T) {
+	bj := synthBubbles()
+	orig := synthTemplate(&bj, 0)
+	truth := synthCurl{synthRotation(0.003, 18.2, 12.6), 8, float64(orig.Rect.Dx()), float64(orig.Rect.Dy())}
+	scan := synthScan(orig, truth, 50)
+	tmpl, err := NewTemplate(&bj, orig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var errs [2]float64
+	for i, warp := range []bool{false, true} {
+		s := NewScanner(tmpl)
+		s.LocalWarp = warp
+		_, err = s.ProcessScannedImage(scan)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if warp != (s.alignment.WarpPoints > 0) {
+			t.Errorf("LocalWarp=%v fitted through %d points", warp, s.alignment.WarpPoints)
+		}
+		errs[i] = transformDistance(s.origToScanned, truth, tmpl)
+	}
+	t.Logf("worst error inside the border %f px global fit, %f px local warp", errs[0], errs[1])
+	if errs[0] < 2 {
+		t.Errorf("global fit only off by %f px, not curled enough for this test", errs[0])
+	}
+	if errs[1] > 1 {
+		t.Errorf("local warp off by %f px", errs[1])
+	}
+}
+
+// Samples are kept further from printed ink by however far the local warp moved a bubble from the global fit.
+func TestInkMarginWarp(t *testing.T) {
+	bj := synthBubbles()
+	tmpl, err := NewTemplate(&bj, synthTemplate(&bj, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := tmpl.styles[0][0].rect
+	s := NewScanner(tmpl)
+	s.origToScanned = synthRotation(0, 12, 9)
+	if m := s.inkMargin(r); m != printedMargin {
+		t.Errorf("unwarped margin %d", m)
+	}
+	s.globalFit = s.origToScanned
+	s.origToScanned = synthRotation(0, 13.2, 8.4)
+	s.alignment.ScaleX = 1
+	s.alignment.ScaleY = 1
+	if m := s.inkMargin(r); m != printedMargin+2 {
+		t.Errorf("margin %d after a 1.3 px warp", m)
+	}
+	// at twice the template's resolution the same shift is half as far on the template
+	s.alignment.ScaleX = 2
+	s.alignment.ScaleY = 2
+	if m := s.inkMargin(r); m != printedMargin+1 {
+		t.Errorf("margin %d after a 1.3 px warp at scale 2", m)
+	}
+}
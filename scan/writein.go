@@ -0,0 +1,90 @@
+package scan
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"math"
+)
+
+// WriteInCrop is the space for a write-in name cut out of a scan and squared up to the template's layout, for adjudicators.
+type WriteInCrop struct {
+	// Image is the write-in space at about the scan's resolution
+	Image *image.Gray `json:"-"`
+
+	// Png is Image, PNG encoded
+	Png []byte `json:"png"`
+
+	// Ink is the fraction of the write-in space that is dark on the scan, leaving out anything printed there
+	Ink float64 `json:"ink"`
+}
+
+// A write-in space with more than this fraction of ink has something written in it, bubble marked or not
+const writeInMinInk = 0.01
+
+// The crop takes in this many points around the write-in space, for writing that runs over its lines
+const writeInPad = 4.0
+
+// spacing of samples measuring ink in a write-in space, in points
+const writeInInkStep = 1.0
+
+// writeInInk is the fraction of the write-in space r that is dark where the template is not
+func (s *Scanner) writeInInk(it *image.Gray, r pxRect) float64 {
+	dark := 0.0
+	area := 0.0
+	margin := s.inkMargin(r)
+	SampleGrid{Step: writeInInkStep}.cells(r, s.t.pxPerPt, func(x, y, a float64) {
+		if s.t.printed(x, y, margin) {
+			return
+		}
+		sx, sy := s.origToScanned.Transform(x, y)
+		if s.sample(it, sx, sy) < s.scanThresh {
+			dark += a
+		}
+		area += a
+	})
+	if area == 0 {
+		return 0
+	}
+	return dark / area
+}
+
+// cropWriteIn resamples the write-in space r, and writeInPad around it, from the scan through origToScanned
+func (s *Scanner) cropWriteIn(it *image.Gray, r pxRect) *image.Gray {
+	pad := writeInPad * s.t.pxPerPt
+	r = pxRect{x: r.x - pad, y: r.y - pad, w: r.w + (2 * pad), h: r.h + (2 * pad)}
+	// scan pixels per template pixel, along the top of the space
+	x0, y0 := s.origToScanned.Transform(r.x, r.y)
+	x1, y1 := s.origToScanned.Transform(r.x+r.w, r.y)
+	scale := math.Max(1, math.Hypot(x1-x0, y1-y0)/r.w)
+	w := int(math.Ceil(r.w * scale))
+	h := int(math.Ceil(r.h * scale))
+	crop := image.NewGray(image.Rect(0, 0, w, h))
+	for oy := 0; oy < h; oy++ {
+		y := r.y + ((float64(oy) + 0.5) / scale)
+		for ox := 0; ox < w; ox++ {
+			x := r.x + ((float64(ox) + 0.5) / scale)
+			sx, sy := s.origToScanned.Transform(x, y)
+			crop.Pix[(oy*crop.Stride)+ox] = s.sample(it, sx, sy)
+		}
+	}
+	return crop
+}
+
+// writeIn cuts out the write-in space r from the upright scan it if its bubble br is marked or there is writing in it, nil if neither.
+// Writing is told from paper on flat, as for bubbles.
+func (s *Scanner) writeIn(it, flat *image.Gray, r pxRect, br *BubbleResult) *WriteInCrop {
+	ink := s.writeInInk(flat, r)
+	if br.Mark == MarkBlank && ink <= writeInMinInk {
+		return nil
+	}
+	wc := &WriteInCrop{Image: s.cropWriteIn(it, r), Ink: ink}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, wc.Image); err != nil {
+		// only for an empty image, and Image is never empty
+		s.debug("write-in png: %v\n", err)
+	} else {
+		wc.Png = buf.Bytes()
+	}
+	return wc
+}
@@ -0,0 +1,131 @@
+package scan
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"testing"
+)
+
+// synthWriteIn adds a write-in selection to council with a ruled space to its right
+func synthWriteIn(bj *BubblesJson) []float64 {
+	xywh := []float64{60, 340, 22, 10, 100, 336, 150, 18}
+	bj.Bubbles[0]["council"]["writein"] = xywh
+	return xywh
+}
+
+func synthWriteInTemplate(bj *BubblesJson, xywh []float64) *image.Gray {
+	orig := synthTemplate(bj, 0)
+	h := orig.Rect.Max.Y
+	x0 := int(xywh[4] * synthPxPerPt)
+	y0 := h - int((xywh[5]+xywh[7])*synthPxPerPt)
+	x1 := int((xywh[4] + xywh[6]) * synthPxPerPt)
+	y1 := h - int(xywh[5]*synthPxPerPt)
+	synthFill(orig, x0-20, y0-20, x1+20, y1+20, 255)
+	synthBubble(orig, xywh[:4], false)
+	// the line to write on
+	synthFill(orig, x0, y1-2, x1, y1, 0)
+	return orig
+}
+
+func TestWriteIn(t *testing.T) {
+	bj := synthBubbles()
+	xywh := synthWriteIn(&bj)
+	tmpl, err := NewTemplate(&bj, synthWriteInTemplate(&bj, xywh))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blank := synthScan(synthWriteInTemplate(&bj, xywh), synthRotation(0.003, 12.4, 9.7), 30)
+	result, err := NewScanner(tmpl).ProcessScannedImage(blank)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wi := result.Contests["council"].Selections["writein"].WriteIn; wi != nil || result.NeedsReview {
+		t.Errorf("blank write-in cropped %v, review %v", wi, result.Review)
+	}
+
+	// a name written in the space, bubble not filled
+	orig := synthWriteInTemplate(&bj, xywh)
+	h := orig.Rect.Max.Y
+	nx := int((xywh[4] + 20) * synthPxPerPt)
+	ny := h - int((xywh[5]+12)*synthPxPerPt)
+	synthFill(orig, nx, ny, nx+60, ny+14, 0)
+	written := synthScan(orig, synthRotation(0.02, 12.4, 9.7), 30)
+	result, err = NewScanner(tmpl).ProcessScannedImage(written)
+	if err != nil {
+		t.Fatal(err)
+	}
+	br := result.Contests["council"].Selections["writein"]
+	if br.Mark != MarkBlank || br.WriteIn == nil {
+		t.Fatalf("write-in %s, crop %v", br.Mark, br.WriteIn)
+	}
+	if len(result.Review) != 1 || result.Review[0].Reason != ReviewWriteIn || result.Review[0].Selection != "writein" {
+		t.Errorf("review %v", result.Review)
+	}
+	if br.WriteIn.Ink <= writeInMinInk {
+		t.Errorf("ink %f", br.WriteIn.Ink)
+	}
+	crop := br.WriteIn.Image
+	wantW := int((xywh[6] + (2 * writeInPad)) * synthPxPerPt)
+	wantH := int((xywh[7] + (2 * writeInPad)) * synthPxPerPt)
+	if d := crop.Rect.Dx() - wantW; d < -1 || d > 1 || crop.Rect.Dy()-wantH < -1 || crop.Rect.Dy()-wantH > 1 {
+		t.Errorf("crop %v, want about %dx%d", crop.Rect, wantW, wantH)
+	}
+	// squared up: the writing is where it was on the page, not turned with the scan
+	padPx := writeInPad * synthPxPerPt
+	pad := int(padPx)
+	cx0 := nx - int(xywh[4]*synthPxPerPt) + pad
+	cy0 := ny - (h - int((xywh[5]+xywh[7])*synthPxPerPt)) + pad
+	for _, p := range [][2]int{{cx0 + 2, cy0 + 2}, {cx0 + 57, cy0 + 2}, {cx0 + 2, cy0 + 11}, {cx0 + 57, cy0 + 11}} {
+		if v := crop.GrayAt(p[0], p[1]).Y; v > 64 {
+			t.Errorf("crop (%d,%d) = %d, want the writing", p[0], p[1], v)
+		}
+	}
+	if v := crop.GrayAt(cx0-6, cy0+7).Y; v < 192 {
+		t.Errorf("crop left of the writing = %d, want paper", v)
+	}
+	im, err := png.Decode(bytes.NewReader(br.WriteIn.Png))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if im.Bounds() != crop.Rect {
+		t.Errorf("png %v, image %v", im.Bounds(), crop.Rect)
+	}
+}
+
+// The crop comes from the scan itself, not the copy adaptive thresholding flattens.
+func TestWriteInAdaptive(t *testing.T) {
+	bj := synthBubbles()
+	xywh := synthWriteIn(&bj)
+	tmpl, err := NewTemplate(&bj, synthWriteInTemplate(&bj, xywh))
+	if err != nil {
+		t.Fatal(err)
+	}
+	orig := synthWriteInTemplate(&bj, xywh)
+	synthBubble(orig, xywh[:4], true)
+	scan := synthScan(orig, synthRotation(0.003, 12.4, 9.7), 30)
+	s := NewScanner(tmpl)
+	s.Threshold = ThresholdSauvola
+	result, err := s.ProcessScannedImage(scan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wi := result.Contests["council"].Selections["writein"].WriteIn
+	if wi == nil {
+		t.Fatal("marked write-in not cropped")
+	}
+	// blank paper in the middle of the space, above the line
+	if v := wi.Image.GrayAt(wi.Image.Rect.Dx()/2, wi.Image.Rect.Dy()/2).Y; v < 240 {
+		t.Errorf("paper in write-in crop = %d, want the scan's white", v)
+	}
+}
+
+func TestWriteInBadLength(t *testing.T) {
+	bj := synthBubbles()
+	bj.Bubbles[0]["council"]["writein"] = []float64{60, 340, 22, 10, 100, 336}
+	_, err := NewTemplate(&bj, synthTemplate(&bj, 0))
+	if ErrorReason(err) != ReasonTemplateLoad {
+		t.Errorf("6 number selection: %v", err)
+	}
+}